@@ -17,5 +17,6 @@ require (
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/olekukonko/ts v0.0.0-20171002115256-78ecb04241c0 // indirect
 	github.com/tcnksm/go-latest v0.0.0-20170313132115-e3007ae9052e
+	go.starlark.net v0.0.0-20210602144842-1cdb82c9e17a
 	golang.org/x/net v0.0.0-20210614182718-04defd469f4e // indirect
 )
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- Apply mode
+//-- When -apply is set, the source database is not queried. The asset changes in a JSON plan written by -plan are made
+//-- instead, exactly as they were reviewed. The Hornbill assets are cached again first, and any asset whose Hornbill
+//-- values no longer match the values cached when the plan was written is refused rather than changed
+
+type applyTypeStruct struct {
+	AssetType assetTypesStruct
+	Indexes   []assetMatchIndexStruct
+	ByID      map[string]map[string]interface{}
+}
+
+// loadPlan -- reads a JSON plan file, and checks that it was written for this instance and mapping configuration
+func loadPlan(planFile string) (plan planStruct, err error) {
+	file, err := os.Open(planFile)
+	if err != nil {
+		return plan, errors.New("Unable to open plan file " + planFile + ": " + err.Error())
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	err = decoder.Decode(&plan)
+	if err != nil {
+		return plan, errors.New("Unable to read plan file " + planFile + ": " + err.Error())
+	}
+	if plan.InstanceID != SQLImportConf.InstanceID {
+		return plan, errors.New("Plan file " + planFile + " was written for instance " + plan.InstanceID + ", not " + SQLImportConf.InstanceID)
+	}
+	if plan.MappingHash != mappingHash {
+		return plan, errors.New("The field mapping configuration has changed since plan file " + planFile + " was written")
+	}
+	for i := range plan.Assets {
+		plan.Assets[i].SourceRecord = getApplyRecord(plan.Assets[i].SourceRecord)
+		for j := range plan.Assets[i].SoftwareAdd {
+			plan.Assets[i].SoftwareAdd[j].SourceRecord = getApplyRecord(plan.Assets[i].SoftwareAdd[j].SourceRecord)
+		}
+	}
+	return plan, nil
+}
+
+// getApplyRecord -- converts the numbers of a source record read from a JSON plan back to the types the mappings expect
+func getApplyRecord(record map[string]interface{}) map[string]interface{} {
+	for k, v := range record {
+		if n, ok := v.(json.Number); ok {
+			record[k] = jsonNumberValue(n)
+		}
+	}
+	return record
+}
+
+// applyPlan -- makes the asset changes in a reviewed plan file, refusing any asset whose Hornbill values have drifted
+func applyPlan(planFile string) {
+	plan, err := loadPlan(planFile)
+	if err != nil {
+		logger(4, "[APPLY] "+err.Error(), true, true)
+		return
+	}
+	logger(1, "[APPLY] Applying "+strconv.Itoa(len(plan.Assets))+" asset changes from plan "+planFile+", written "+plan.Created, true, true)
+
+	applyTypes := make(map[string]applyTypeStruct)
+	getApplyType := func(typeName string) (applyTypeStruct, error) {
+		if applyType, ok := applyTypes[typeName]; ok {
+			return applyType, nil
+		}
+		for _, v := range SQLImportConf.AssetTypes {
+			if v.AssetType != typeName {
+				continue
+			}
+			v = setAssetType(v)
+			if v.Class == "" || v.TypeID == 0 {
+				return applyTypeStruct{}, errors.New("Unable to get the class of asset type " + typeName)
+			}
+			assetCache, err := cacheAssetType(v)
+			if err != nil {
+				return applyTypeStruct{}, err
+			}
+			applyType := applyTypeStruct{AssetType: v, Indexes: buildMatchIndexes(assetCache, v), ByID: make(map[string]map[string]interface{})}
+			for _, record := range assetCache {
+				applyType.ByID[iToS(record["h_pk_asset_id"])] = record
+				for _, duplicate := range getDuplicateAssets(record) {
+					applyType.ByID[iToS(duplicate["h_pk_asset_id"])] = duplicate
+				}
+			}
+			applyTypes[typeName] = applyType
+			return applyType, nil
+		}
+		return applyTypeStruct{}, errors.New("Asset type " + typeName + " is not in the configuration")
+	}
+
+	espXmlmc := apiLib.NewXmlmcInstance(SQLImportConf.InstanceID)
+	espXmlmc.SetAPIKey(SQLImportConf.APIKey)
+	for _, entry := range plan.Assets {
+		var buffer bytes.Buffer
+		buffer.WriteString(loggerGen(1, "    "))
+		buffer.WriteString(loggerGen(1, "[APPLY] "+strings.TrimRight(formatPlanAsset(entry), "\n")))
+		applyPlanAsset(entry, getApplyType, espXmlmc, &buffer)
+		loggerWriteBuffer(buffer.String())
+	}
+}
+
+// applyPlanAsset -- makes the planned changes for a single asset
+func applyPlanAsset(entry planAssetStruct, getApplyType func(string) (applyTypeStruct, error), espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	refuse := func(reason string) {
+		buffer.WriteString(loggerGen(5, "[APPLY] Asset change refused: "+reason))
+		mutexCounters.Lock()
+		counters.applyRefused++
+		mutexCounters.Unlock()
+	}
+
+	fromTypeName := entry.AssetType
+	if entry.Action == "Reclassify" {
+		fromTypeName = entry.FromAssetType
+	}
+	fromType, err := getApplyType(fromTypeName)
+	if err != nil {
+		refuse(err.Error())
+		return
+	}
+	applyType, err := getApplyType(entry.AssetType)
+	if err != nil {
+		refuse(err.Error())
+		return
+	}
+	//Set the asset type globals that records are created against
+	setAssetTypeGlobals(applyType.AssetType)
+	assetType := applyType.AssetType
+
+	var hbRecord map[string]interface{}
+	switch entry.Action {
+	case "Create":
+		if cacheKey, matchRule := matchAssetIndexes(entry.SourceRecord, applyType.Indexes); cacheKey != "" {
+			refuse("a matching asset has been created since the plan was written, matched by rule " + matchRule)
+			return
+		}
+	case "Update", "Reclassify", "Retire", "Archive":
+		var ok bool
+		hbRecord, ok = fromType.ByID[entry.AssetID]
+		if !ok {
+			refuse("asset " + entry.AssetID + " is no longer a " + fromTypeName + " asset in Hornbill")
+			return
+		}
+		driftRecord := hbRecord
+		if entry.Action == "Reclassify" {
+			//The planned changes were compared against the asset as it would be once moved
+			driftRecord = getMovedAssetRecord(hbRecord, fromType.AssetType, assetType)
+		}
+		if drift := getPlanDrift(entry, driftRecord); len(drift) > 0 {
+			for _, field := range drift {
+				buffer.WriteString(loggerGen(5, "[APPLY] "+field))
+			}
+			refuse("the Hornbill values of asset " + entry.AssetID + " have changed since the plan was written")
+			return
+		}
+	default:
+		refuse("unknown plan action " + entry.Action)
+		return
+	}
+
+	var hbSoftware map[string]softwareRecordDetailsStruct
+	if entry.Action != "Create" && (len(entry.SoftwareAdd) > 0 || len(entry.SoftwareRemove) > 0 || len(entry.SoftwareRestore) > 0) {
+		hbSoftware, err = getHornbillSoftware(entry.AssetID, espXmlmc, buffer)
+		if err != nil {
+			refuse(err.Error())
+			return
+		}
+		if drift := getSoftwareDrift(entry, hbSoftware); len(drift) > 0 {
+			for _, app := range drift {
+				buffer.WriteString(loggerGen(5, "[APPLY] "+app))
+			}
+			refuse("the software inventory of asset " + entry.AssetID + " has changed since the plan was written")
+			return
+		}
+	}
+
+	strAssetID := entry.AssetID
+	actioned := false
+	switch entry.Action {
+	case "Create":
+		strAssetID, actioned = createAsset(assetType, entry.SourceRecord, entry.SourceID, espXmlmc, nil, buffer)
+		if !actioned {
+			return
+		}
+	case "Reclassify":
+		if !reclassifyAsset(hbRecord, fromType.AssetType, assetType, espXmlmc, buffer) {
+			return
+		}
+		actioned = applyFieldChanges(entry, assetType, espXmlmc, buffer)
+	default:
+		actioned = applyFieldChanges(entry, assetType, espXmlmc, buffer)
+	}
+	if !actioned {
+		return
+	}
+
+	if len(entry.SoftwareAdd) > 0 || len(entry.SoftwareRemove) > 0 || len(entry.SoftwareRestore) > 0 {
+		applySoftwareChanges(entry, strAssetID, assetType, espXmlmc, buffer)
+	}
+	postAssetTimeline(strAssetID, espXmlmc, buffer)
+	if entry.Contract != "" {
+		addContract(strAssetID, entry.Contract, espXmlmc, buffer)
+	}
+	if entry.Supplier != "" {
+		connectSupplier(strAssetID, entry.Supplier, espXmlmc, buffer)
+	}
+}
+
+// getPlanDrift -- compares the Hornbill values an asset had when the plan was written to its current values,
+// and returns a description of each field that has changed since
+func getPlanDrift(entry planAssetStruct, hbRecord map[string]interface{}) (drift []string) {
+	for _, change := range entry.Changes {
+		if change.NotCached {
+			continue
+		}
+		currentValue := iToS(hbRecord[change.Field])
+		if normaliseFieldValue(currentValue) != normaliseFieldValue(change.OldValue) {
+			drift = append(drift, change.Entity+"."+change.Field+" was "+strconv.Quote(change.OldValue)+" when planned, and is now "+strconv.Quote(currentValue))
+		}
+	}
+	return
+}
+
+// getSoftwareDrift -- checks that the software records to remove still exist, and the software records to add do not
+func getSoftwareDrift(entry planAssetStruct, hbSoftware map[string]softwareRecordDetailsStruct) (drift []string) {
+	for _, software := range entry.SoftwareRemove {
+		if record, ok := hbSoftware[software.AppID]; !ok || record.HPKID != software.RecordID {
+			drift = append(drift, "Software "+software.AppID+" record "+strconv.Itoa(software.RecordID)+" no longer exists")
+		}
+	}
+	for _, software := range entry.SoftwareAdd {
+		if _, ok := hbSoftware[software.AppID]; ok {
+			drift = append(drift, "Software "+software.AppID+" has already been added")
+		}
+	}
+	for _, software := range entry.SoftwareRestore {
+		if record, ok := hbSoftware[software.AppID]; !ok || record.HPKID != software.RecordID {
+			drift = append(drift, "Software "+software.AppID+" record "+strconv.Itoa(software.RecordID)+" no longer exists")
+		}
+	}
+	return
+}
+
+// applyFieldChanges -- writes the planned field changes of an existing asset
+func applyFieldChanges(entry planAssetStruct, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+	var primaryChanges, extendedChanges []assetFieldChangeStruct
+	for _, change := range entry.Changes {
+		if change.Entity == "Asset" {
+			primaryChanges = append(primaryChanges, change)
+		} else {
+			extendedChanges = append(extendedChanges, change)
+		}
+	}
+	if len(primaryChanges) == 0 && len(extendedChanges) == 0 {
+		return true
+	}
+	updatedBy := "Import - Update"
+	if entry.Action == "Retire" || entry.Action == "Archive" {
+		updatedBy = "Import - " + entry.Action
+	}
+	if hasDataChanges(entry.Changes, assetType) {
+		primaryChanges = append(primaryChanges,
+			assetFieldChangeStruct{Entity: "Asset", Field: "h_last_updated", NewValue: time.Now().Format("2006-01-02 15:04:05")},
+			assetFieldChangeStruct{Entity: "Asset", Field: "h_last_updated_by", NewValue: updatedBy},
+		)
+	}
+	setAssetUpdateParams(entry.AssetID, primaryChanges, extendedChanges, espXmlmc)
+	err := invokeEntityChange(espXmlmc, "entityUpdateRecord", "Asset Apply", buffer)
+	mutexCounters.Lock()
+	defer mutexCounters.Unlock()
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to apply planned changes to Asset: "+err.Error()))
+		if entry.Action == "Retire" || entry.Action == "Archive" {
+			counters.retireFailed++
+		} else {
+			counters.updateFailed++
+		}
+		return false
+	}
+	switch {
+	case configDryRun && (entry.Action == "Retire" || entry.Action == "Archive"):
+		counters.retireSkipped++
+	case configDryRun:
+		counters.updateSkipped++
+	case entry.Action == "Retire" || entry.Action == "Archive":
+		counters.retired++
+	default:
+		counters.updated++
+	}
+	buffer.WriteString(loggerGen(1, "Planned changes applied to Asset: "+entry.AssetID))
+	journalAssetChanges("Update", entry.AssetID, append(primaryChanges, extendedChanges...), buffer)
+	return true
+}
+
+// applySoftwareChanges -- adds and removes the planned software inventory records of an asset, and stores the
+// software fingerprint once every change has been made
+func applySoftwareChanges(entry planAssetStruct, strAssetID string, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	if configDryRun {
+		buffer.WriteString(loggerGen(1, "Software inventory changes skipped in dry run mode"))
+		return
+	}
+	boolUpdateSoftwareHash := true
+	removedSoftware := make(map[string]removedSoftwareStruct)
+	if softRemovalEnabled(assetType) {
+		var err error
+		removedSoftware, err = getRemovedSoftware(strAssetID, assetType, espXmlmc, buffer)
+		if err != nil {
+			buffer.WriteString(loggerGen(4, "Unable to cache removed software inventory records: "+err.Error()))
+			return
+		}
+	}
+	for _, software := range entry.SoftwareRemove {
+		record := softwareRecordDetailsStruct{HPKID: software.RecordID, HAppID: software.AppID, HAppName: software.Name}
+		if err := removeAssetSoftware(strAssetID, record, removedSoftware, assetType, espXmlmc, buffer); err != nil {
+			buffer.WriteString(loggerGen(4, "Error deleting software inventory record: "+err.Error()))
+			mutexCounters.Lock()
+			counters.softwareRemoveFailed++
+			mutexCounters.Unlock()
+			boolUpdateSoftwareHash = false
+		}
+	}
+	for _, software := range entry.SoftwareRestore {
+		removed, ok := removedSoftware[software.AppID]
+		if !ok {
+			continue
+		}
+		if err := restoreSoftwareRecord(strAssetID, removed, assetType, espXmlmc, buffer); err != nil {
+			buffer.WriteString(loggerGen(4, "Error restoring software record ["+software.AppID+"]:"+err.Error()))
+			mutexCounters.Lock()
+			counters.softwareCreateFailed++
+			mutexCounters.Unlock()
+			boolUpdateSoftwareHash = false
+		}
+	}
+	for _, software := range entry.SoftwareAdd {
+		if _, err := addSoftwareInventoryRecord(strAssetID, software.SourceRecord, assetType, espXmlmc, buffer); err != nil {
+			buffer.WriteString(loggerGen(4, "Error creating software record ["+software.AppID+"]:"+err.Error()))
+			mutexCounters.Lock()
+			counters.softwareCreateFailed++
+			mutexCounters.Unlock()
+			boolUpdateSoftwareHash = false
+		}
+	}
+	if !boolUpdateSoftwareHash || entry.SoftwareFingerprint == "" {
+		return
+	}
+	fingerprint := []assetFieldChangeStruct{{Entity: getClassEntity(assetType.Class), Field: "h_dsc_sw_fingerprint", NewValue: entry.SoftwareFingerprint}}
+	setAssetUpdateParams(strAssetID, nil, fingerprint, espXmlmc)
+	if err := invokeEntityChange(espXmlmc, "entityUpdateRecord", "Asset Software Fingerprint", buffer); err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to update Asset Software Inventory fingerprint: "+err.Error()))
+	}
+}
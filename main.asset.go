@@ -50,10 +50,12 @@ func getAssetRecords(assetCount uint64, assetType assetTypesStruct, espXmlmc *ap
 	var (
 		loopCount uint64
 		queryType string
-		recordMap = make(map[string]map[string]interface{})
-		err       error
+		recordMap  = make(map[string]map[string]interface{})
+		duplicates = make(map[string][]map[string]interface{})
+		err        error
 	)
 	pageSize = 1000
+	keyColumn := getCacheKeyColumn(assetType)
 	switch assetType.Class {
 	case "basic":
 		queryType = "recordsBasic"
@@ -115,14 +117,22 @@ func getAssetRecords(assetCount uint64, assetType assetTypesStruct, espXmlmc *ap
 			break
 		}
 		for _, v := range JSONResp.Params.RowData.Row {
-			if v[assetType.AssetIdentifier.EntityColumn] != nil {
+			if v[keyColumn] != nil {
 				bar.Add(1)
-				keyVal := fmt.Sprintf("%s", v[assetType.AssetIdentifier.EntityColumn])
+				keyVal := fmt.Sprintf("%s", v[keyColumn])
+				if existing, ok := recordMap[keyVal]; ok {
+					if len(duplicates[keyVal]) == 0 {
+						duplicates[keyVal] = append(duplicates[keyVal], existing)
+					}
+					duplicates[keyVal] = append(duplicates[keyVal], v)
+				}
 				recordMap[keyVal] = v
 			}
 		}
 	}
 	bar.FinishPrint("Hornbill " + assetType.AssetType + " Asset Records Cached \n")
+	resolveDuplicates(recordMap, duplicates, assetType)
+	resolveMatchRuleDuplicates(recordMap, assetType)
 
 	return recordMap, err
 }
@@ -171,6 +181,7 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 	blnContractConnect := supplierManagerInstalled() && assetType.AssetIdentifier.DBContractColumn != ""
 	blnSupplierConnect := supplierManagerInstalled() && assetType.AssetIdentifier.DBSupplierColumn != ""
 	blnCMInPolicy := configManagerInstalled() && assetType.AssetIdentifier.DBInPolicyColumn != ""
+	scriptFunction := getScriptFunction(assetType)
 
 	//-- Loop each asset
 	maxGoroutinesGuard := make(chan struct{}, maxGoroutines)
@@ -182,15 +193,12 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 			hbRecordHash    string
 			hbSIRecordHash  string
 			dbRecordHash    string
-			assetForHash    []map[string]interface{}
 			assetMap        = assetRecord
 		)
 
 		//Get the asset ID for the current record
 		assetID := iToS(assetMap[assetIDIdent])
 
-		dbRecordHash = Hash(append(assetForHash, assetRecord))
-
 		go func() {
 			defer worker.Done()
 			mutexBar.Lock()
@@ -198,10 +206,13 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 			mutexBar.Unlock()
 
 			var (
+				hbRecord            map[string]interface{}
 				boolUpdate          = false
 				boolUpdateSI        = false
 				boolCreate          = false
 				boolActioned        = false
+				matchedBy           string
+				movedFrom           string
 				buffer              bytes.Buffer
 				softwareRecords     map[string]map[string]interface{}
 				softwareRecordsHash string
@@ -220,9 +231,50 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 			buffer.WriteString(loggerGen(1, "    "))
 			buffer.WriteString(loggerGen(1, "Processing Asset: "+assetID))
 
-			if asset, ok := assetsCache[assetID]; ok {
+			//Run the transform script against the source record
+			if scriptFunction != "" {
+				newAssetMap, skip, err := runScript(scriptFunction, assetMap, &buffer)
+				if err != nil || skip {
+					mutexCounters.Lock()
+					if err != nil {
+						counters.scriptFailed++
+						buffer.WriteString(loggerGen(4, err.Error()))
+					} else {
+						counters.scriptSkipped++
+						buffer.WriteString(loggerGen(1, "Asset skipped by script function "+scriptFunction))
+					}
+					mutexCounters.Unlock()
+					mutexBuffer.Lock()
+					loggerWriteBuffer(buffer.String())
+					mutexBuffer.Unlock()
+					<-maxGoroutinesGuard
+					return
+				}
+				assetMap = newAssetMap
+			}
+			dbRecordHash = getRecordHash(assetType, assetMap)
+
+			cacheKey, matchRule := matchAsset(assetMap)
+			if asset, ok := assetsCache[cacheKey]; ok && cacheKey != "" {
 				//Asset exists
+				buffer.WriteString(loggerGen(1, "Asset matched by rule: "+matchRule))
+				matchedBy = matchRule
+				if isDuplicateSkipped(asset) {
+					buffer.WriteString(loggerGen(5, "Asset matches duplicate Hornbill assets, skipped as DuplicatePolicy is None"))
+					mutexCounters.Lock()
+					counters.duplicateSkipped++
+					mutexCounters.Unlock()
+					mutexBuffer.Lock()
+					loggerWriteBuffer(buffer.String())
+					mutexBuffer.Unlock()
+					<-maxGoroutinesGuard
+					return
+				}
+				hbRecord = asset
 				assetIDInstance = fmt.Sprintf("%v", asset["h_pk_asset_id"])
+				mutexAssets.Lock()
+				assets[assetID] = assetIDInstance
+				mutexAssets.Unlock()
 				debugLog(&buffer, "Asset ID Instance"+assetIDInstance)
 				debugLog(&buffer, "Asset Class: "+assetType.Class)
 				switch assetType.Class {
@@ -231,7 +283,7 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 					hbRecordHash = fmt.Sprintf("%v", asset["h_dsc_cf_fingerprint"])
 					debugLog(&buffer, "Database Asset Record Hash: "+dbRecordHash)
 					debugLog(&buffer, "Hornbill Asset Record Hash: "+hbRecordHash)
-					if hbRecordHash != dbRecordHash {
+					if forceRecords() || hbRecordHash != dbRecordHash {
 						boolUpdate = true
 					} else {
 						mutexCounters.Lock()
@@ -251,7 +303,7 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 						counters.softwareCreateFailed++
 						mutexCounters.Unlock()
 					}
-					if len(softwareRecords) > 0 && hbSIRecordHash != softwareRecordsHash {
+					if len(softwareRecords) > 0 && (forceSoftware() || hbSIRecordHash != softwareRecordsHash) {
 						boolUpdateSI = true
 					} else {
 						buffer.WriteString(loggerGen(1, "Asset match found, no software inventory updates required"))
@@ -265,7 +317,7 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 					hbRecordHash = fmt.Sprintf("%v", asset["h_dsc_fingerprint"])
 					debugLog(&buffer, "Database Asset Record Hash: "+dbRecordHash)
 					debugLog(&buffer, "Hornbill Asset Record Hash: "+hbRecordHash)
-					if hbRecordHash != dbRecordHash {
+					if forceRecords() || hbRecordHash != dbRecordHash {
 						boolUpdate = true
 					} else {
 						mutexCounters.Lock()
@@ -283,7 +335,7 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 						counters.softwareCreateFailed++
 						mutexCounters.Unlock()
 					}
-					if len(softwareRecords) > 0 && hbSIRecordHash != softwareRecordsHash {
+					if len(softwareRecords) > 0 && (forceSoftware() || hbSIRecordHash != softwareRecordsHash) {
 						boolUpdateSI = true
 					} else {
 						buffer.WriteString(loggerGen(1, "Asset match found, no software inventory updates required"))
@@ -296,7 +348,7 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 					hbRecordHash = fmt.Sprintf("%v", asset["h_dsc_siid"])
 					debugLog(&buffer, "Database Asset Record Hash: "+dbRecordHash)
 					debugLog(&buffer, "Hornbill Asset Record Hash: "+hbRecordHash)
-					if hbRecordHash != dbRecordHash {
+					if forceRecords() || hbRecordHash != dbRecordHash {
 						boolUpdate = true
 					} else {
 						mutexCounters.Lock()
@@ -312,23 +364,78 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 					hbRecordHash = fmt.Sprintf("%v", asset["h_dsc_fingerprint"])
 					debugLog(&buffer, "Database Asset Record Hash: "+dbRecordHash)
 					debugLog(&buffer, "Hornbill Asset Record Hash: "+hbRecordHash)
-					if hbRecordHash != dbRecordHash {
+					if forceRecords() || hbRecordHash != dbRecordHash {
 						boolUpdate = true
 					} else {
 						mutexCounters.Lock()
 						counters.updateSkipped++
 						mutexCounters.Unlock()
 					}
-					boolUpdate = true
 				}
 				if !boolUpdate {
 					buffer.WriteString(loggerGen(1, "Asset match found, no details require updating"))
 				}
+			} else if fromType, asset, matchRule := findMovedAsset(assetMap, assetType); asset != nil {
+				//Asset exists against another asset type
+				buffer.WriteString(loggerGen(1, "Asset matched against "+fromType.AssetType+" asset by rule: "+matchRule))
+				matchedBy = matchRule
+				movedFrom = fromType.AssetType
+				if assetType.OperationType == "" || strings.ToLower(assetType.OperationType) == "both" || strings.ToLower(assetType.OperationType) == "update" {
+					if reclassifyAsset(asset, fromType, assetType, espXmlmc, &buffer) {
+						hbRecord = getMovedAssetRecord(asset, fromType, assetType)
+						assetIDInstance = iToS(asset["h_pk_asset_id"])
+						mutexAssets.Lock()
+						assets[assetID] = assetIDInstance
+						mutexAssets.Unlock()
+						boolUpdate = true
+					}
+				} else {
+					buffer.WriteString(loggerGen(1, "Asset matched against another asset type, but OperationType not set to Both or Update"))
+				}
 			} else {
 				debugLog(&buffer, "Asset Match Doesn't Exist - Create")
 				boolCreate = true
 			}
 
+			//-- Rehash only: store the fingerprints without updating any other fields, and create nothing
+			if configRehashOnly {
+				if boolCreate {
+					buffer.WriteString(loggerGen(1, "Asset match not found, create skipped in rehash-only mode"))
+					mutexCounters.Lock()
+					counters.createSkipped++
+					mutexCounters.Unlock()
+				} else {
+					for _, duplicate := range getDuplicateAssets(hbRecord) {
+						buffer.WriteString(loggerGen(1, "Rehash Duplicate Asset: "+iToS(duplicate["h_pk_asset_id"])))
+						rehashAsset(iToS(duplicate["h_pk_asset_id"]), assetType, duplicate, dbRecordHash, "", espXmlmc, &buffer)
+					}
+					rehashAsset(assetIDInstance, assetType, hbRecord, dbRecordHash, softwareRecordsHash, espXmlmc, &buffer)
+				}
+				boolUpdate, boolUpdateSI, boolCreate = false, false, false
+			}
+
+			//-- Plan only: record the changes that would be made, without making them
+			if configPlan {
+				if boolUpdate || boolUpdateSI || boolCreate {
+					planEntry := planAssetStruct{AssetType: assetType.AssetType, SourceID: assetID, AssetID: assetIDInstance, MatchRule: matchedBy, FromAssetType: movedFrom}
+					if blnContractConnect {
+						planEntry.Contract = iToS(assetMap[assetType.AssetIdentifier.DBContractColumn])
+					}
+					if blnSupplierConnect {
+						planEntry.Supplier = iToS(assetMap[assetType.AssetIdentifier.DBSupplierColumn])
+					}
+					planAssetChanges(planEntry, assetType, assetMap, hbRecord, boolUpdate, boolUpdateSI, softwareRecords, softwareRecordsHash, espXmlmc, db, &buffer)
+				}
+				if boolUpdate && hbRecord != nil {
+					//Duplicates are updated along with the matched asset, but their software inventory is not synced
+					for _, duplicate := range getDuplicateAssets(hbRecord) {
+						duplicateEntry := planAssetStruct{AssetType: assetType.AssetType, SourceID: assetID, AssetID: iToS(duplicate["h_pk_asset_id"]), MatchRule: matchedBy}
+						planAssetChanges(duplicateEntry, assetType, assetMap, duplicate, true, false, nil, "", espXmlmc, db, &buffer)
+					}
+				}
+				boolUpdate, boolUpdateSI, boolCreate = false, false, false
+			}
+
 			//-- Update or Create Asset
 			if boolUpdate {
 				if assetType.OperationType == "" || strings.ToLower(assetType.OperationType) == "both" || strings.ToLower(assetType.OperationType) == "update" {
@@ -337,7 +444,12 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 						usedBy = iToS(assetMap["h_used_by_name"])
 					}
 					buffer.WriteString(loggerGen(1, "Update Asset: "+assetID))
-					boolActioned = updateAsset(assetType, assetMap, assetIDInstance, assetID, usedBy, espXmlmc, db, &buffer)
+					for _, duplicate := range getDuplicateAssets(hbRecord) {
+						buffer.WriteString(loggerGen(1, "Update Duplicate Asset: "+iToS(duplicate["h_pk_asset_id"])))
+						updateAsset(assetType, assetMap, duplicate, iToS(duplicate["h_pk_asset_id"]), assetID, usedBy, espXmlmc, db, &buffer)
+						postAssetTimeline(iToS(duplicate["h_pk_asset_id"]), espXmlmc, &buffer)
+					}
+					boolActioned = updateAsset(assetType, assetMap, hbRecord, assetIDInstance, assetID, usedBy, espXmlmc, db, &buffer)
 				} else {
 					buffer.WriteString(loggerGen(1, "Asset match found, but OperationType not set to Both or Update"))
 				}
@@ -355,8 +467,12 @@ func processAssets(arrAssets map[string]map[string]interface{}, assetsCache map[
 				if err != nil {
 					buffer.WriteString(loggerGen(4, err.Error()))
 				}
+			} else if hbRecord != nil {
+				purgeRemovedSoftware(assetIDInstance, assetType, espXmlmc, &buffer)
 			}
 
+			postAssetTimeline(assetIDInstance, espXmlmc, &buffer)
+
 			// additional stuff
 			if boolActioned && assetIDInstance != "" {
 				if blnContractConnect {
@@ -399,9 +515,9 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 		softwareRecordsHash string
 	)
 
-	var assetForHash []map[string]interface{}
-	newAssetHash = Hash(append(assetForHash, u))
-	if assetType.Class == "computer" || assetType.Class == "mobileDevice" {
+	newAssetHash = getRecordHash(assetType, u)
+	//No source DB connection is passed when the software inventory is added separately, as when a plan is applied
+	if db != nil && (assetType.Class == "computer" || assetType.Class == "mobileDevice") {
 		softwareRecords, softwareRecordsHash, err = getSoftwareRecords(u, assetType, espXmlmc, db, buffer)
 		if err != nil {
 			buffer.WriteString(loggerGen(4, err.Error()))
@@ -411,6 +527,16 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 		}
 	}
 
+	//Check mapped values against the entity schema
+	err = checkRecordValues(assetType, u, "create")
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to add asset: "+err.Error()))
+		mutexCounters.Lock()
+		counters.createFailed++
+		mutexCounters.Unlock()
+		return "", false
+	}
+
 	//Get site ID
 	siteID, siteName := getSiteID(u, buffer)
 
@@ -444,7 +570,10 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 	//Get asset field mapping
 	debugLog(buffer, "Asset Field Mapping")
 	for k, v := range SQLImportConf.AssetGenericFieldMapping {
-		strMapping := fmt.Sprintf("%v", v)
+		if !fieldModeAllowed(v, "create") {
+			continue
+		}
+		strMapping := getFieldMapping(k, v, u, buffer)
 		value := getFieldValue(k, strMapping, u, buffer)
 		debugLog(buffer, k, ":", strMapping, ":", value)
 
@@ -483,6 +612,7 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 			k != "h_company_name" &&
 			k != "h_department_name" &&
 			strMapping != "" && value != "" {
+			value, _ = checkFieldValue("Asset", k, value, buffer)
 			espXmlmc.SetParam(k, value)
 		}
 	}
@@ -495,27 +625,18 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 	espXmlmc.SetParam("entityAction", "insert")
 	espXmlmc.OpenElement("record")
 	espXmlmc.SetParam("h_type", strconv.Itoa(AssetTypeID))
-	switch assetType.Class {
-	case "computer":
-		espXmlmc.SetParam("h_dsc_cf_fingerprint", newAssetHash)
-		if softwareRecordsHash != "" {
-			espXmlmc.SetParam("h_dsc_sw_fingerprint", softwareRecordsHash)
-		}
-	case "printer":
-		espXmlmc.SetParam("h_dsc_cf_fingerprint", newAssetHash)
-	case "mobileDevice":
-		espXmlmc.SetParam("h_dsc_fingerprint", newAssetHash)
-		if softwareRecordsHash != "" {
-			espXmlmc.SetParam("h_dsc_sw_fingerprint", softwareRecordsHash)
-		}
-	default:
-		espXmlmc.SetParam("h_dsc_fingerprint", newAssetHash)
+	espXmlmc.SetParam(getFingerprintColumn(assetType.Class), newAssetHash)
+	if (assetType.Class == "computer" || assetType.Class == "mobileDevice") && softwareRecordsHash != "" {
+		espXmlmc.SetParam("h_dsc_sw_fingerprint", softwareRecordsHash)
 	}
 	debugLog(buffer, "Asset Type Field Mapping")
 
 	//Get asset field mapping
 	for k, v := range SQLImportConf.AssetTypeFieldMapping {
-		strMapping := fmt.Sprintf("%v", v)
+		if !fieldModeAllowed(v, "create") {
+			continue
+		}
+		strMapping := getFieldMapping(k, v, u, buffer)
 		value := getFieldValue(k, strMapping, u, buffer)
 		debugLog(buffer, k, ":", strMapping, ":", value)
 
@@ -526,6 +647,7 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 		if k != "h_last_logged_on_user" &&
 			strMapping != "" &&
 			value != "" {
+			value, _ = checkFieldValue(getClassEntity(assetType.Class), k, value, buffer)
 			espXmlmc.SetParam(k, value)
 		}
 	}
@@ -572,6 +694,7 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 			assets[strNewAssetID] = assetID
 			mutexAssets.Unlock()
 			buffer.WriteString(loggerGen(1, "Asset record created successfully: "+assetID))
+			writeJournal(journalEntryStruct{Action: "Create", AssetID: assetID, Entity: getClassEntity(assetType.Class)}, buffer)
 
 			//Now add asset URN
 			espXmlmc.SetParam("application", "com.hornbill.servicemanager")
@@ -625,140 +748,61 @@ func createAsset(assetType assetTypesStruct, u map[string]interface{}, strNewAss
 }
 
 // updateAsset -- Updates Asset record from the passed through map data and asset ID
-func updateAsset(assetType assetTypesStruct, u map[string]interface{}, strAssetID, strNewAssetID, usedBy string, espXmlmc *apiLib.XmlmcInstStruct, db *sqlx.DB, buffer *bytes.Buffer) bool {
-
-	var (
-		newAssetHash      string
-		boolRecordUpdated = false
-	)
-
-	//Shared clearAttrib array
-	var nilAttrib []apiLib.ParamAttribStruct
-	attrib := apiLib.ParamAttribStruct{}
-	attrib.Name = "nil"
-	attrib.Value = "true"
-	nilAttrib = append(nilAttrib, attrib)
-
-	var assetForHash []map[string]interface{}
-	newAssetHash = Hash(append(assetForHash, u))
-
-	//Get site ID
-	siteID, siteName := getSiteID(u, buffer)
-
-	//Get Company ID
-	companyID, companyName := getGroupID(u, "company", buffer)
-
-	//Get Department ID
-	departmentID, departmentName := getGroupID(u, "department", buffer)
-
-	//Get Owned By details
-	ownedByID, ownedByURN, ownedByName := getUserID(u, "h_owned_by", buffer)
-
-	//Get Used By details
-	usedByID, usedByURN, usedByName := getUserID(u, "h_used_by", buffer)
-
-	//Get Last Logged On details
-	_, lastLoggedOnByURN, _ := getUserID(u, "h_last_logged_on_user", buffer)
-
-	//Get/Set params from map stored against FieldMapping
-	espXmlmc.SetParam("application", appServiceManager)
-	espXmlmc.SetParam("entity", "Asset")
-	espXmlmc.SetParam("returnModifiedData", "true")
-	espXmlmc.OpenElement("primaryEntityData")
-	espXmlmc.OpenElement("record")
-	espXmlmc.SetParam("h_pk_asset_id", strAssetID)
-	espXmlmc.SetParam("h_asset_urn", "urn:sys:entity:com.hornbill.servicemanager:Asset:"+strAssetID)
-	debugLog(buffer, "Asset Field Mapping")
-
-	//Get asset field mapping
-	for k, v := range SQLImportConf.AssetGenericFieldMapping {
-		strMapping := fmt.Sprintf("%v", v)
-		value := getFieldValue(k, strMapping, u, buffer)
-		debugLog(buffer, k, ":", strMapping, ":", value)
-
-		if k == "h_operational_state" && assetType.PreserveOperationalState {
-			//Skip updating op state
-			continue
-		}
+// hbRecord is the cached Hornbill record for the asset, only fields whose values differ from it are sent
+func updateAsset(assetType assetTypesStruct, u map[string]interface{}, hbRecord map[string]interface{}, strAssetID, strNewAssetID, usedBy string, espXmlmc *apiLib.XmlmcInstStruct, db *sqlx.DB, buffer *bytes.Buffer) bool {
 
-		if k == "h_record_state" && assetType.PreserveState {
-			//Skip updating state
-			continue
-		}
+	var boolRecordUpdated = false
 
-		if (k == "h_substate_id" || k == "h_substate_name") && assetType.PreserveSubState {
-			//Skip updating subState
-			continue
-		}
+	//Check mapped values against the entity schema
+	if err := checkRecordValues(assetType, u, "update"); err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to Update Asset: "+err.Error()))
+		mutexCounters.Lock()
+		counters.updateFailed++
+		mutexCounters.Unlock()
+		return false
+	}
 
-		if k == "h_used_by" && usedByID != "" {
-			if usedByID == "__clear__" {
-				espXmlmc.SetParamAttr("h_used_by", "", nilAttrib)
-				espXmlmc.SetParamAttr("h_used_by_name", "", nilAttrib)
-			} else if usedByName != "" && usedByURN != "" {
-				espXmlmc.SetParam("h_used_by", usedByURN)
-				espXmlmc.SetParam("h_used_by_name", usedByName)
-			}
-			continue
-		}
+	//Build the desired record, and compare it to the cached Hornbill record
+	primaryFields, extendedFields := getAssetFields(assetType, u, hbRecord, strAssetID, "update", buffer)
+	primaryChanges := getFieldChanges("Asset", primaryFields, hbRecord)
+	extendedChanges := getFieldChanges(getClassEntity(assetType.Class), extendedFields, hbRecord)
 
-		if k == "h_owned_by" && ownedByID != "" {
-			if ownedByID == "__clear__" {
-				espXmlmc.SetParamAttr("h_owned_by", "", nilAttrib)
-				espXmlmc.SetParamAttr("h_owned_by_name", "", nilAttrib)
-			} else if ownedByName != "" && ownedByURN != "" {
-				espXmlmc.SetParam("h_owned_by", ownedByURN)
-				espXmlmc.SetParam("h_owned_by_name", ownedByName)
-			}
-			continue
-		}
+	mutexAssets.Lock()
+	assets[strNewAssetID] = strAssetID
+	mutexAssets.Unlock()
 
-		if k == "h_site" && siteName != "" {
-			if siteName == "__clear__" {
-				espXmlmc.SetParamAttr("h_site", "", nilAttrib)
-				espXmlmc.SetParamAttr("h_site_id", "", nilAttrib)
-			} else if siteID != 0 {
-				espXmlmc.SetParam("h_site", siteName)
-				espXmlmc.SetParam("h_site_id", strconv.Itoa(siteID))
-			}
-			continue
-		}
-
-		if k == "h_company_name" && companyName != "" {
-			if companyName == "__clear__" {
-				espXmlmc.SetParamAttr("h_company_name", "", nilAttrib)
-				espXmlmc.SetParamAttr("h_company_id", "", nilAttrib)
-			} else if companyID != "" {
-				espXmlmc.SetParam("h_company_name", companyName)
-				espXmlmc.SetParam("h_company_id", companyID)
-			}
-			continue
-		}
+	if len(primaryChanges) == 0 && len(extendedChanges) == 0 {
+		buffer.WriteString(loggerGen(1, "Asset match found, no field values differ from Hornbill - update skipped"))
+		mutexCounters.Lock()
+		counters.updateSkipped++
+		mutexCounters.Unlock()
+		return true
+	}
+	for _, change := range append(primaryChanges, extendedChanges...) {
+		debugLog(buffer, "Field change:", change.Entity+"."+change.Field, ":", change.OldValue, "->", change.NewValue)
+	}
 
-		if k == "h_department_name" && departmentName != "" {
-			if departmentName == "__clear__" {
-				espXmlmc.SetParamAttr("h_department_name", "", nilAttrib)
-				espXmlmc.SetParamAttr("h_department_id", "", nilAttrib)
-			} else if departmentID != "" {
-				espXmlmc.SetParam("h_department_name", departmentName)
-				espXmlmc.SetParam("h_department_id", departmentID)
-			}
-			continue
+	if configDryRun {
+		//-- Inc Counter
+		mutexCounters.Lock()
+		counters.updateSkipped++
+		mutexCounters.Unlock()
+		if len(primaryChanges) > 0 {
+			setAssetUpdateParams(strAssetID, primaryChanges, nil, espXmlmc)
+			buffer.WriteString(loggerGen(1, "Asset Update XML "+espXmlmc.GetParam()))
+			espXmlmc.ClearParam()
 		}
-
-		if value == "__clear__" {
-			espXmlmc.SetParamAttr(k, "", nilAttrib)
-		} else if strMapping != "" && value != "" {
-			espXmlmc.SetParam(k, value)
+		if len(extendedChanges) > 0 {
+			setAssetUpdateParams(strAssetID, nil, extendedChanges, espXmlmc)
+			buffer.WriteString(loggerGen(1, "Asset Extended Update XML "+espXmlmc.GetParam()))
+			espXmlmc.ClearParam()
 		}
+		return true
 	}
 
-	espXmlmc.CloseElement("record")
-	espXmlmc.CloseElement("primaryEntityData")
-
-	var XMLSTRING = espXmlmc.GetParam()
-
-	if !configDryRun {
+	if len(primaryChanges) > 0 {
+		setAssetUpdateParams(strAssetID, primaryChanges, nil, espXmlmc)
+		var XMLSTRING = espXmlmc.GetParam()
 		debugLog(buffer, "Asset Update XML:", XMLSTRING)
 
 		XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
@@ -800,58 +844,16 @@ func updateAsset(assetType assetTypesStruct, u map[string]interface{}, strAssetI
 
 		if xmlRespon.MethodResult == "ok" {
 			buffer.WriteString(loggerGen(1, "Asset record updated successfully: "+strAssetID))
+			journalAssetChanges("Update", strAssetID, primaryChanges, buffer)
 			boolRecordUpdated = true
 		}
+	}
 
-		assets[strNewAssetID] = strAssetID
-
-		//-- now process extended record data
-		espXmlmc.SetParam("application", appServiceManager)
-		espXmlmc.SetParam("entity", "Asset")
-		espXmlmc.SetParam("returnModifiedData", "true")
-		espXmlmc.OpenElement("primaryEntityData")
-		espXmlmc.OpenElement("record")
-		espXmlmc.SetParam("h_pk_asset_id", strAssetID)
-		espXmlmc.CloseElement("record")
-		espXmlmc.CloseElement("primaryEntityData")
-		espXmlmc.OpenElement("relatedEntityData")
-		espXmlmc.SetParam("relationshipName", "AssetClass")
-		espXmlmc.SetParam("entityAction", "update")
-		espXmlmc.OpenElement("record")
-		espXmlmc.SetParam("h_pk_asset_id", strAssetID)
-		switch assetType.Class {
-		case "basic":
-			espXmlmc.SetParam("h_dsc_fingerprint", newAssetHash)
-		case "computer":
-			espXmlmc.SetParam("h_dsc_cf_fingerprint", newAssetHash)
-		case "printer":
-			espXmlmc.SetParam("h_dsc_cf_fingerprint", newAssetHash)
-		case "software":
-			espXmlmc.SetParam("h_dsc_fingerprint", newAssetHash)
-		}
-		debugLog(buffer, "Asset Field Mapping")
-
-		//Get asset field mapping
-		for k, v := range SQLImportConf.AssetTypeFieldMapping {
-			strMapping := fmt.Sprintf("%v", v)
-			value := getFieldValue(k, strMapping, u, buffer)
-			debugLog(buffer, k, ":", strMapping, ":", value)
-			if value == "__clear__" {
-				espXmlmc.SetParamAttr(k, "", nilAttrib)
-			} else {
-				if k == "h_last_logged_on_user" && lastLoggedOnByURN != "" {
-					espXmlmc.SetParam("h_last_logged_on_user", lastLoggedOnByURN)
-				}
-				if k != "h_last_logged_on_user" && strMapping != "" && value != "" {
-					espXmlmc.SetParam(k, value)
-				}
-			}
-		}
-
-		espXmlmc.CloseElement("record")
-		espXmlmc.CloseElement("relatedEntityData")
-		XMLMCRequest := espXmlmc.GetParam()
-		debugLog(buffer, "Asset Extended Update XML:", XMLMCRequest)
+	//-- now process extended record data
+	if len(extendedChanges) > 0 {
+		setAssetUpdateParams(strAssetID, nil, extendedChanges, espXmlmc)
+		XMLSTRING := espXmlmc.GetParam()
+		debugLog(buffer, "Asset Extended Update XML:", XMLSTRING)
 
 		XMLUpdateExt, xmlmcErrExt := espXmlmc.Invoke("data", "entityUpdateRecord")
 		if xmlmcErrExt != nil {
@@ -864,7 +866,7 @@ func updateAsset(assetType assetTypesStruct, u map[string]interface{}, strAssetI
 		}
 		var xmlResponExt xmlmcUpdateResponse
 
-		err = xml.Unmarshal([]byte(XMLUpdateExt), &xmlResponExt)
+		err := xml.Unmarshal([]byte(XMLUpdateExt), &xmlResponExt)
 		if err != nil {
 			buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance when Updating Asset Extended Details:"+err.Error()))
 			buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
@@ -874,7 +876,7 @@ func updateAsset(assetType assetTypesStruct, u map[string]interface{}, strAssetI
 			return false
 		}
 
-		if xmlRespon.MethodResult != "ok" && xmlRespon.State.ErrorRet != "There are no values to update" && !strings.Contains(xmlRespon.State.ErrorRet, "Superfluous entity record update detected") {
+		if xmlResponExt.MethodResult != "ok" && xmlResponExt.State.ErrorRet != "There are no values to update" && !strings.Contains(xmlResponExt.State.ErrorRet, "Superfluous entity record update detected") {
 			buffer.WriteString(loggerGen(4, "Unable to Update Asset Extended Details: "+xmlResponExt.State.ErrorRet))
 			buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
 			mutexCounters.Lock()
@@ -883,63 +885,305 @@ func updateAsset(assetType assetTypesStruct, u map[string]interface{}, strAssetI
 			return false
 		}
 
-		if xmlRespon.MethodResult != "ok" && (xmlRespon.State.ErrorRet == "There are no values to update" || strings.Contains(xmlRespon.State.ErrorRet, "Superfluous entity record update detected")) {
+		if xmlResponExt.MethodResult != "ok" && (xmlResponExt.State.ErrorRet == "There are no values to update" || strings.Contains(xmlResponExt.State.ErrorRet, "Superfluous entity record update detected")) {
 			mutexCounters.Lock()
 			counters.updateRelatedSkipped++
 			mutexCounters.Unlock()
 		}
 
-		if xmlRespon.MethodResult == "ok" {
+		if xmlResponExt.MethodResult == "ok" {
+			journalAssetChanges("Update", strAssetID, extendedChanges, buffer)
+		}
+		if xmlResponExt.MethodResult == "ok" && hasDataChanges(extendedChanges, assetType) {
 			boolRecordUpdated = true
 			buffer.WriteString(loggerGen(1, "Asset record extended details updated successfully: "+strAssetID))
 		}
+	}
 
-		if boolRecordUpdated {
-			//-- Asset Updated!
-			//-- Need to run another update against the Asset for LAST UPDATED and LAST UPDATE BY!
-			espXmlmc.SetParam("application", appServiceManager)
-			espXmlmc.SetParam("entity", "Asset")
-			espXmlmc.OpenElement("primaryEntityData")
-			espXmlmc.OpenElement("record")
-			espXmlmc.SetParam("h_pk_asset_id", strAssetID)
-			espXmlmc.SetParam("h_last_updated", time.Now().Format("2006-01-02 15:04:05"))
-			espXmlmc.SetParam("h_last_updated_by", "Import - Update")
-			espXmlmc.CloseElement("record")
-			espXmlmc.CloseElement("primaryEntityData")
-			var XMLSTRING = espXmlmc.GetParam()
-			debugLog(buffer, "Asset Update LAST UPDATE XML:", XMLSTRING)
+	if boolRecordUpdated {
+		//-- Asset Updated!
+		//-- Need to run another update against the Asset for LAST UPDATED and LAST UPDATE BY!
+		espXmlmc.SetParam("application", appServiceManager)
+		espXmlmc.SetParam("entity", "Asset")
+		espXmlmc.OpenElement("primaryEntityData")
+		espXmlmc.OpenElement("record")
+		espXmlmc.SetParam("h_pk_asset_id", strAssetID)
+		espXmlmc.SetParam("h_last_updated", time.Now().Format("2006-01-02 15:04:05"))
+		espXmlmc.SetParam("h_last_updated_by", "Import - Update")
+		espXmlmc.CloseElement("record")
+		espXmlmc.CloseElement("primaryEntityData")
+		var XMLSTRING = espXmlmc.GetParam()
+		debugLog(buffer, "Asset Update LAST UPDATE XML:", XMLSTRING)
 
-			XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
-			if xmlmcErr != nil {
-				buffer.WriteString(loggerGen(4, "API Call failed when setting Last Updated values:"+xmlmcErr.Error()))
+		XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
+		if xmlmcErr != nil {
+			buffer.WriteString(loggerGen(4, "API Call failed when setting Last Updated values:"+xmlmcErr.Error()))
+			buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		} else {
+			var xmlRespon xmlmcResponse
+			err := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+			if err != nil {
+				buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance when setting Last Updated values:"+err.Error()))
 				buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
 			} else {
-				var xmlRespon xmlmcResponse
-				err := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
-				if err != nil {
-					buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance when setting Last Updated values:"+err.Error()))
+				if xmlRespon.MethodResult != "ok" && xmlRespon.State.ErrorRet != "There are no values to update" {
+					buffer.WriteString(loggerGen(4, "Unable to set Last Updated details for asset: "+xmlRespon.State.ErrorRet))
 					buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
 				} else {
-					if xmlRespon.MethodResult != "ok" && xmlRespon.State.ErrorRet != "There are no values to update" {
-						buffer.WriteString(loggerGen(4, "Unable to set Last Updated details for asset: "+xmlRespon.State.ErrorRet))
-						buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
-					} else {
-						buffer.WriteString(loggerGen(1, "Asset Last Updated date & user updated successfully: "+strAssetID))
-					}
+					buffer.WriteString(loggerGen(1, "Asset Last Updated date & user updated successfully: "+strAssetID))
 				}
 			}
-			mutexCounters.Lock()
-			counters.updated++
-			mutexCounters.Unlock()
 		}
-
-	} else {
-		//-- Inc Counter
+		mutexCounters.Lock()
+		counters.updated++
+		mutexCounters.Unlock()
+	} else if len(primaryChanges) == 0 {
+		//-- Only the fingerprint has changed
 		mutexCounters.Lock()
 		counters.updateSkipped++
 		mutexCounters.Unlock()
-		buffer.WriteString(loggerGen(1, "Asset Update XML "+XMLSTRING))
-		espXmlmc.ClearParam()
 	}
 	return true
 }
+
+// getAssetFields -- Builds the primary and extended fields that a create or update operation would set from the source record
+func getAssetFields(assetType assetTypesStruct, u map[string]interface{}, hbRecord map[string]interface{}, strAssetID string, operation string, buffer *bytes.Buffer) (primaryFields, extendedFields []assetFieldStruct) {
+	//Get site ID
+	siteID, siteName := getSiteID(u, buffer)
+
+	//Get Company ID
+	companyID, companyName := getGroupID(u, "company", buffer)
+
+	//Get Department ID
+	departmentID, departmentName := getGroupID(u, "department", buffer)
+
+	//Get Owned By details
+	ownedByID, ownedByURN, ownedByName := getUserID(u, "h_owned_by", buffer)
+
+	//Get Used By details
+	usedByID, usedByURN, usedByName := getUserID(u, "h_used_by", buffer)
+
+	//Get Last Logged On details
+	_, lastLoggedOnByURN, _ := getUserID(u, "h_last_logged_on_user", buffer)
+
+	setField := func(fields *[]assetFieldStruct, k, value string) {
+		*fields = append(*fields, assetFieldStruct{Field: k, Value: value})
+	}
+	clearField := func(fields *[]assetFieldStruct, k string) {
+		//Columns are only cleared by updates
+		if operation == "update" {
+			*fields = append(*fields, assetFieldStruct{Field: k, Clear: true})
+		}
+	}
+
+	//The asset URN is only set if it is returned in the cache, otherwise it would be sent with every update
+	if _, ok := hbRecord["h_asset_urn"]; operation == "update" && (ok || hbRecord == nil) {
+		setField(&primaryFields, "h_asset_urn", "urn:sys:entity:com.hornbill.servicemanager:Asset:"+strAssetID)
+	}
+	debugLog(buffer, "Asset Field Mapping")
+
+	//Get asset field mapping
+	for k, v := range SQLImportConf.AssetGenericFieldMapping {
+		if !fieldModeAllowed(v, operation) || fieldFilled(v, k, hbRecord, buffer) {
+			continue
+		}
+		strMapping := getFieldMapping(k, v, u, buffer)
+		value := getFieldValue(k, strMapping, u, buffer)
+		debugLog(buffer, k, ":", strMapping, ":", value)
+
+		if k == "h_operational_state" && assetType.PreserveOperationalState && operation == "update" {
+			//Skip updating op state
+			continue
+		}
+
+		if k == "h_record_state" && assetType.PreserveState && operation == "update" {
+			//Skip updating state
+			continue
+		}
+
+		if (k == "h_substate_id" || k == "h_substate_name") && assetType.PreserveSubState && operation == "update" {
+			//Skip updating subState
+			continue
+		}
+
+		if k == "h_used_by" && usedByID != "" {
+			if usedByID == "__clear__" {
+				clearField(&primaryFields, "h_used_by")
+				clearField(&primaryFields, "h_used_by_name")
+			} else if usedByName != "" && usedByURN != "" {
+				setField(&primaryFields, "h_used_by", usedByURN)
+				setField(&primaryFields, "h_used_by_name", usedByName)
+			}
+			continue
+		}
+
+		if k == "h_owned_by" && ownedByID != "" {
+			if ownedByID == "__clear__" {
+				clearField(&primaryFields, "h_owned_by")
+				clearField(&primaryFields, "h_owned_by_name")
+			} else if ownedByName != "" && ownedByURN != "" {
+				setField(&primaryFields, "h_owned_by", ownedByURN)
+				setField(&primaryFields, "h_owned_by_name", ownedByName)
+			}
+			continue
+		}
+
+		if k == "h_site" && siteName != "" {
+			if siteName == "__clear__" {
+				clearField(&primaryFields, "h_site")
+				clearField(&primaryFields, "h_site_id")
+			} else if siteID != 0 {
+				setField(&primaryFields, "h_site", siteName)
+				setField(&primaryFields, "h_site_id", strconv.Itoa(siteID))
+			}
+			continue
+		}
+
+		if k == "h_company_name" && companyName != "" {
+			if companyName == "__clear__" {
+				clearField(&primaryFields, "h_company_name")
+				clearField(&primaryFields, "h_company_id")
+			} else if companyID != "" {
+				setField(&primaryFields, "h_company_name", companyName)
+				setField(&primaryFields, "h_company_id", companyID)
+			}
+			continue
+		}
+
+		if k == "h_department_name" && departmentName != "" {
+			if departmentName == "__clear__" {
+				clearField(&primaryFields, "h_department_name")
+				clearField(&primaryFields, "h_department_id")
+			} else if departmentID != "" {
+				setField(&primaryFields, "h_department_name", departmentName)
+				setField(&primaryFields, "h_department_id", departmentID)
+			}
+			continue
+		}
+
+		if value == "__clear__" {
+			clearField(&primaryFields, k)
+		} else if strMapping != "" && value != "" {
+			value, _ = checkFieldValue("Asset", k, value, buffer)
+			setField(&primaryFields, k, value)
+		}
+	}
+
+	//Extended record fingerprint
+	setField(&extendedFields, getFingerprintColumn(assetType.Class), getRecordHash(assetType, u))
+	debugLog(buffer, "Asset Type Field Mapping")
+
+	//Get asset type field mapping
+	for k, v := range SQLImportConf.AssetTypeFieldMapping {
+		if !fieldModeAllowed(v, operation) || fieldFilled(v, k, hbRecord, buffer) {
+			continue
+		}
+		strMapping := getFieldMapping(k, v, u, buffer)
+		value := getFieldValue(k, strMapping, u, buffer)
+		debugLog(buffer, k, ":", strMapping, ":", value)
+		if value == "__clear__" {
+			clearField(&extendedFields, k)
+		} else {
+			if k == "h_last_logged_on_user" && lastLoggedOnByURN != "" {
+				setField(&extendedFields, "h_last_logged_on_user", lastLoggedOnByURN)
+			}
+			if k != "h_last_logged_on_user" && strMapping != "" && value != "" {
+				value, _ = checkFieldValue(getClassEntity(assetType.Class), k, value, buffer)
+				setField(&extendedFields, k, value)
+			}
+		}
+	}
+	return
+}
+
+// getFingerprintColumn -- Returns the extended record column that holds the record fingerprint of an asset of the class
+// This is the column that processAssets compares the source record hash against, to decide if the asset needs updating
+func getFingerprintColumn(assetClass string) string {
+	switch assetClass {
+	case "computer":
+		return "h_dsc_cf_fingerprint"
+	case "printer":
+		return "h_dsc_siid"
+	}
+	return "h_dsc_fingerprint"
+}
+
+// getFieldChanges -- Compares the desired field values against the cached Hornbill record, and returns the fields that differ
+// Fields that are not returned in the cached record are always treated as changed
+func getFieldChanges(entity string, fields []assetFieldStruct, hbRecord map[string]interface{}) (changes []assetFieldChangeStruct) {
+	for _, field := range fields {
+		cachedValue, inCache := hbRecord[field.Field]
+		oldValue := iToS(cachedValue)
+		if inCache && normaliseFieldValue(oldValue) == normaliseFieldValue(field.Value) {
+			continue
+		}
+		changes = append(changes, assetFieldChangeStruct{
+			Entity:    entity,
+			Field:     field.Field,
+			OldValue:  oldValue,
+			NewValue:  field.Value,
+			Clear:     field.Clear,
+			NotCached: !inCache,
+		})
+	}
+	return
+}
+
+// normaliseFieldValue -- Normalises a value for comparison, so that formatting differences between the source and Hornbill are ignored
+func normaliseFieldValue(value string) string {
+	value = strings.TrimSpace(value)
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return value
+}
+
+// hasDataChanges -- Returns true if the changes include any field other than the fingerprint
+func hasDataChanges(changes []assetFieldChangeStruct, assetType assetTypesStruct) bool {
+	for _, change := range changes {
+		if change.Field != getFingerprintColumn(assetType.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+// setAssetUpdateParams -- Sets the entityUpdateRecord params to apply primary and/or extended field changes to an asset
+func setAssetUpdateParams(strAssetID string, primaryChanges, extendedChanges []assetFieldChangeStruct, espXmlmc *apiLib.XmlmcInstStruct) {
+	//Shared clearAttrib array
+	var nilAttrib []apiLib.ParamAttribStruct
+	attrib := apiLib.ParamAttribStruct{}
+	attrib.Name = "nil"
+	attrib.Value = "true"
+	nilAttrib = append(nilAttrib, attrib)
+
+	setChanges := func(changes []assetFieldChangeStruct) {
+		for _, change := range changes {
+			if change.Clear {
+				espXmlmc.SetParamAttr(change.Field, "", nilAttrib)
+			} else {
+				espXmlmc.SetParam(change.Field, change.NewValue)
+			}
+		}
+	}
+
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Asset")
+	espXmlmc.SetParam("returnModifiedData", "true")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_asset_id", strAssetID)
+	setChanges(primaryChanges)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	if len(extendedChanges) > 0 {
+		espXmlmc.OpenElement("relatedEntityData")
+		espXmlmc.SetParam("relationshipName", "AssetClass")
+		espXmlmc.SetParam("entityAction", "update")
+		espXmlmc.OpenElement("record")
+		espXmlmc.SetParam("h_pk_asset_id", strAssetID)
+		setChanges(extendedChanges)
+		espXmlmc.CloseElement("record")
+		espXmlmc.CloseElement("relatedEntityData")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -32,6 +34,46 @@ func initXMLMC() {
 // getFieldValue --Retrieve field value from mapping via SQL record map
 func getFieldValue(k string, v string, u map[string]interface{}, buffer *bytes.Buffer) string {
 	debugLog(buffer, "getFieldValue:", k, ":", v)
+	if !strings.Contains(v, "{{") {
+		return getFieldColumns(k, v, u, buffer)
+	}
+
+	//-- Evaluate {{expression}} blocks, text outside of them is mapped as normal
+	var fieldValue strings.Builder
+	fieldMap := v
+	for fieldMap != "" {
+		start := strings.Index(fieldMap, "{{")
+		if start == -1 {
+			fieldValue.WriteString(getFieldColumns(k, fieldMap, u, buffer))
+			break
+		}
+		end := strings.Index(fieldMap[start:], "}}")
+		if end == -1 {
+			buffer.WriteString(loggerGen(4, "Mapping expression for "+k+" is missing closing }}: "+v))
+			fieldValue.WriteString(getFieldColumns(k, fieldMap, u, buffer))
+			break
+		}
+		if start > 0 {
+			fieldValue.WriteString(getFieldColumns(k, fieldMap[:start], u, buffer))
+		}
+		expr := fieldMap[start+2 : start+end]
+		exprValue, err := evalExpression(expr, u)
+		if err != nil {
+			buffer.WriteString(loggerGen(4, "Unable to evaluate mapping expression for "+k+" ["+expr+"]: "+err.Error()))
+		} else {
+			if exprValue != "" && isDateField(k) {
+				exprValue = checkDateString(k, exprValue, buffer)
+			}
+			debugLog(buffer, "expression:", expr, ":", exprValue)
+			fieldValue.WriteString(exprValue)
+		}
+		fieldMap = fieldMap[start+end+2:]
+	}
+	return fieldValue.String()
+}
+
+// getFieldColumns -- Replaces [Column] references in a mapping with the values from the SQL record map
+func getFieldColumns(k string, v string, u map[string]interface{}, buffer *bytes.Buffer) string {
 	fieldMap := v
 	//-- Match $variable from String
 	re1, err := regexp.Compile(`\[(.*?)\]`)
@@ -58,8 +100,8 @@ func getFieldValue(k string, v string, u map[string]interface{}, buffer *bytes.B
 		}
 		debugLog(buffer, "valFieldMap 2:", valFieldMap)
 		if valFieldMap != "" {
-			if strings.Contains(strings.ToLower(k), "date") {
-				valFieldMap = checkDateString(valFieldMap)
+			if isDateField(k) {
+				valFieldMap = checkDateString(k, valFieldMap, buffer)
 			}
 			if strings.HasPrefix(valFieldMap, "[") && strings.HasSuffix(valFieldMap, "]") && valFieldMap == fieldMap {
 				valFieldMap = ""
@@ -198,13 +240,6 @@ func loggerWriteBuffer(s string) {
 	}
 }
 
-// checkDateString - returns date from supplied string
-func checkDateString(strDate string) string {
-	re, _ := regexp.Compile(`\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`)
-	strNewDate := re.FindString(strDate)
-	return strNewDate
-}
-
 func debugLog(buffer *bytes.Buffer, debugStrings ...string) {
 	if configDebug {
 		if buffer == nil {
@@ -241,6 +276,57 @@ func Hash(arr []map[string]interface{}) string {
 	return md5str
 }
 
+// getMappingHash -- returns a hash of the mapping configuration, so that changing the mappings causes assets to be updated
+// The transform script and the functions it is called with are included, as they change the values that are mapped
+func getMappingHash() string {
+	mappingConf := map[string]interface{}{
+		"AssetGenericFieldMapping": SQLImportConf.AssetGenericFieldMapping,
+		"AssetTypeFieldMapping":    SQLImportConf.AssetTypeFieldMapping,
+		"Lookups":                  SQLImportConf.Lookups,
+		"DateConf":                 SQLImportConf.DateConf,
+	}
+	if SQLImportConf.Script.File != "" {
+		//A script that cannot be read is reported by loadScript
+		scriptBytes, _ := os.ReadFile(SQLImportConf.Script.File)
+		scriptFunctions := map[string]string{"": SQLImportConf.Script.Function}
+		for _, v := range SQLImportConf.AssetTypes {
+			scriptFunctions[v.AssetType] = v.ScriptFunction
+		}
+		mappingConf["Script"] = string(scriptBytes)
+		mappingConf["ScriptFunctions"] = scriptFunctions
+	}
+	return Hash([]map[string]interface{}{mappingConf})
+}
+
+// getRecordHash -- returns the fingerprint of a source record, calculated from the final mapped field values and the
+// mapping configuration rather than the whole source row, so that assets are only updated when Hornbill would change
+func getRecordHash(assetType assetTypesStruct, u map[string]interface{}) string {
+	var mappingBuffer bytes.Buffer
+	recordValues := map[string]interface{}{"__mapping": mappingHash}
+	mappings := map[string]map[string]interface{}{
+		"Asset":                         SQLImportConf.AssetGenericFieldMapping,
+		getClassEntity(assetType.Class): SQLImportConf.AssetTypeFieldMapping,
+	}
+	for entity, mapping := range mappings {
+		for k, v := range mapping {
+			if isHashExcluded(k) {
+				continue
+			}
+			recordValues[entity+"."+k] = getFieldValue(k, getFieldMapping(k, v, u, &mappingBuffer), u, &mappingBuffer)
+		}
+	}
+	return Hash([]map[string]interface{}{recordValues})
+}
+
+func isHashExcluded(k string) bool {
+	for _, col := range SQLImportConf.HashExcludeColumns {
+		if strings.EqualFold(col, k) {
+			return true
+		}
+	}
+	return false
+}
+
 // espLogger -- Log to ESP
 func espLogger(message string, severity string) {
 	if configDryRun {
@@ -252,3 +338,31 @@ func espLogger(message string, severity string) {
 	hornbillImport.SetParam("message", message)
 	hornbillImport.Invoke("system", "logMessage")
 }
+
+// invokeEntityChange -- invokes an entity API call with the params already set, and returns an error if it fails
+// In dry run mode the call XML is logged instead
+func invokeEntityChange(espXmlmc *apiLib.XmlmcInstStruct, method string, description string, buffer *bytes.Buffer) error {
+	XMLSTRING := espXmlmc.GetParam()
+	if configDryRun {
+		buffer.WriteString(loggerGen(1, description+" XML "+XMLSTRING))
+		espXmlmc.ClearParam()
+		return nil
+	}
+	debugLog(buffer, description+" XML:", XMLSTRING)
+	XMLResponse, xmlmcErr := espXmlmc.Invoke("data", method)
+	if xmlmcErr != nil {
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		return errors.New("API Call failed: " + xmlmcErr.Error())
+	}
+	var xmlRespon xmlmcResponse
+	err := xml.Unmarshal([]byte(XMLResponse), &xmlRespon)
+	if err != nil {
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		return errors.New("Unable to read response from Hornbill instance: " + err.Error())
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		return errors.New(xmlRespon.State.ErrorRet)
+	}
+	return nil
+}
@@ -141,7 +141,7 @@ func getCount(query string) uint64 {
 }
 
 func getUserID(u map[string]interface{}, userCol string, buffer *bytes.Buffer) (userID, userURN, userName string) {
-	userMapping := fmt.Sprintf("%v", SQLImportConf.AssetGenericFieldMapping[userCol])
+	userMapping := getFieldMapping(userCol, SQLImportConf.AssetGenericFieldMapping[userCol], u, buffer)
 	userID = getFieldValue(userCol, userMapping, u, buffer)
 	if userID != "" && userID != "<nil>" && userID != "__clear__" {
 		mutexCustomers.Lock()
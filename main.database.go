@@ -89,26 +89,39 @@ func queryAssets(sqlAppend string, assetType assetTypesStruct) (bool, map[string
 	//Initialise Asset Map
 	arrAssetMaps := make(map[string]map[string]interface{})
 
+	boolSQLAssets, rows := runAssetQuery(sqlAppend, assetType.AssetType)
+	for _, results := range rows {
+		//Stick marshalled data map in to parent slice
+		arrAssetMaps[fmt.Sprintf("%s", results[assetType.AssetIdentifier.DBColumn])] = results
+	}
+	return boolSQLAssets, arrAssetMaps
+}
+
+//runAssetQuery -- Runs the base asset query with the supplied SQL appended
+//-- Returns the rows as maps, and true if successful
+func runAssetQuery(sqlAppend string, description string) (bool, []map[string]interface{}) {
+	var arrAssetRows []map[string]interface{}
+
 	db, err := makeDBConnection()
 	if err != nil {
 		logger(4, "[DATABASE] "+err.Error(), true, true)
-		return false, arrAssetMaps
+		return false, arrAssetRows
 	}
 	defer db.Close()
 	logger(1, " ", false, false)
-	logger(3, "[DATABASE] Running database query for "+assetType.AssetType+" assets. Please wait...", true, true)
+	logger(3, "[DATABASE] Running database query for "+description+" assets. Please wait...", true, true)
 	//build query
 	sqlAssetQuery := BaseSQLQuery + " " + sqlAppend
-	logger(3, "[DATABASE] Query for "+assetType.AssetType+" assets:"+sqlAssetQuery, false, true)
+	logger(3, "[DATABASE] Query for "+description+" assets:"+sqlAssetQuery, false, true)
 	//Run Query
 	rows, err := db.Queryx(sqlAssetQuery)
 	if err != nil {
 		logger(4, " [DATABASE] Database Query Error: "+fmt.Sprintf("%v", err), true, true)
-		return false, arrAssetMaps
+		return false, arrAssetRows
 	}
 	defer rows.Close()
 
-	//Build map full of assets
+	//Build slice full of assets
 	intAssetCount := 0
 	intAssetSuccess := 0
 	for rows.Next() {
@@ -118,13 +131,12 @@ func queryAssets(sqlAppend string, assetType assetTypesStruct) (bool, map[string
 		if err != nil {
 			logger(4, " [DATABASE] Data Unmarshal Error: "+fmt.Sprintf("%v", err), true, true)
 		} else {
-			//Stick marshalled data map in to parent slice
-			arrAssetMaps[fmt.Sprintf("%s", results[assetType.AssetIdentifier.DBColumn])] = results
+			arrAssetRows = append(arrAssetRows, results)
 			intAssetSuccess++
 		}
 	}
 	logger(3, "[DATABASE] "+strconv.Itoa(intAssetSuccess)+" of "+strconv.Itoa(intAssetCount)+" returned assets successfully retrieved ready for processing.", true, true)
-	return true, arrAssetMaps
+	return true, arrAssetRows
 }
 
 func querySoftwareInventoryRecords(assetID string, assetTypeDetails assetTypesStruct, db *sqlx.DB, buffer *bytes.Buffer) (map[string]map[string]interface{}, string, error) {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	//Embedded timezone database, so source timezones can be loaded on Windows
+	_ "time/tzdata"
+)
+
+const hornbillDateFormat = "2006-01-02 15:04:05"
+
+var (
+	dateLocations = make(map[string]*time.Location)
+	reDateString  = regexp.MustCompile(`\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`)
+)
+
+// loadDateConf -- validates the DateConf section of the configuration and loads the source timezones
+func loadDateConf() error {
+	timezones := []string{SQLImportConf.DateConf.Timezone}
+	for _, v := range SQLImportConf.DateConf.Fields {
+		timezones = append(timezones, v.Timezone)
+	}
+	for _, tz := range timezones {
+		if _, ok := dateLocations[tz]; ok {
+			continue
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return errors.New("Unable to load timezone [" + tz + "]: " + err.Error())
+		}
+		dateLocations[tz] = loc
+	}
+	return nil
+}
+
+// getDateLocation -- returns a source timezone loaded by loadDateConf, defaulting to UTC
+func getDateLocation(timezone string) *time.Location {
+	if loc, ok := dateLocations[timezone]; ok {
+		return loc
+	}
+	return time.UTC
+}
+
+// isDateField -- returns true if values for the Hornbill field should be converted to a Hornbill date
+func isDateField(k string) bool {
+	if _, ok := SQLImportConf.DateConf.Fields[k]; ok {
+		return true
+	}
+	return strings.Contains(strings.ToLower(k), "date")
+}
+
+// checkDateString - returns the supplied date as a UTC date string in the format Hornbill expects
+func checkDateString(k string, strDate string, buffer *bytes.Buffer) string {
+	formats := SQLImportConf.DateConf.InputFormats
+	timezone := SQLImportConf.DateConf.Timezone
+	if fieldConf, ok := SQLImportConf.DateConf.Fields[k]; ok {
+		if len(fieldConf.InputFormats) > 0 {
+			formats = fieldConf.InputFormats
+		}
+		if fieldConf.Timezone != "" {
+			timezone = fieldConf.Timezone
+		}
+	}
+	parsedDate, err := parseDate(strings.TrimSpace(strDate), formats, getDateLocation(timezone))
+	if err != nil {
+		buffer.WriteString(loggerGen(5, "Unable to parse date for "+k+" ["+strDate+"]: "+err.Error()))
+		return ""
+	}
+	return parsedDate.UTC().Format(hornbillDateFormat)
+}
+
+// parseDate -- parses a date using the list of input formats. Formats are Go time layouts, or one of:
+// epoch (Unix seconds), epochms (Unix milliseconds) or iso8601 (with or without a UTC offset)
+// If no formats are supplied, a yyyy-mm-dd hh:mm:ss date is extracted from the value, or an ISO-8601 date is parsed
+func parseDate(strDate string, formats []string, loc *time.Location) (time.Time, error) {
+	if len(formats) == 0 {
+		if match := reDateString.FindString(strDate); match != "" {
+			return time.ParseInLocation(hornbillDateFormat, match, loc)
+		}
+		formats = []string{"iso8601"}
+	}
+	for _, format := range formats {
+		switch strings.ToLower(format) {
+		case "epoch", "epochms":
+			epoch, err := strconv.ParseInt(strDate, 10, 64)
+			if err != nil {
+				continue
+			}
+			if strings.ToLower(format) == "epochms" {
+				return time.Unix(0, epoch*int64(time.Millisecond)), nil
+			}
+			return time.Unix(epoch, 0), nil
+		case "iso8601":
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05", "2006-01-02"} {
+				if parsed, err := time.ParseInLocation(layout, strDate, loc); err == nil {
+					return parsed, nil
+				}
+			}
+		default:
+			if parsed, err := time.ParseInLocation(format, strDate, loc); err == nil {
+				return parsed, nil
+			}
+		}
+	}
+	return time.Time{}, errors.New("value does not match any of the accepted date formats")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Records that share a cache key with the asset that was kept in the cache, keyed on the kept asset's primary key
+var (
+	duplicateAssets        = make(map[string][]map[string]interface{})
+	duplicateSkippedAssets = make(map[string]bool)
+)
+
+// checkDuplicatePolicy -- validates the DuplicatePolicy from the configuration
+func checkDuplicatePolicy() error {
+	switch strings.ToLower(SQLImportConf.DuplicatePolicy) {
+	case "", "newest", "oldest", "all", "none":
+		return nil
+	}
+	return errors.New("DuplicatePolicy must be Newest, Oldest, All or None")
+}
+
+// resolveDuplicates -- applies the DuplicatePolicy to groups of Hornbill assets that share the same cache key,
+// keeps one record of each group in the cache, and writes the groups to the duplicates report
+// Without a policy, the newest record is kept and the others are not updated
+func resolveDuplicates(recordMap map[string]map[string]interface{}, duplicates map[string][]map[string]interface{}, assetType assetTypesStruct) {
+	for key, kept := range resolveDuplicateGroups(duplicates, assetType.AssetIdentifier.EntityColumn, assetType) {
+		recordMap[key] = kept
+	}
+}
+
+// resolveDuplicateGroups -- applies the DuplicatePolicy to groups of Hornbill assets that share the same key value,
+// and returns the record kept from each group. keyName is the column or match rule the groups share a value of
+func resolveDuplicateGroups(duplicates map[string][]map[string]interface{}, keyName string, assetType assetTypesStruct) map[string]map[string]interface{} {
+	keptRecords := make(map[string]map[string]interface{})
+	if len(duplicates) == 0 {
+		return keptRecords
+	}
+	policy := strings.ToLower(SQLImportConf.DuplicatePolicy)
+	var keys []string
+	for key := range duplicates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var reportRows [][]string
+	for _, key := range keys {
+		records := duplicates[key]
+		sort.Slice(records, func(i, j int) bool {
+			return comparePrimaryKeys(iToS(records[i]["h_pk_asset_id"]), iToS(records[j]["h_pk_asset_id"]))
+		})
+		kept := records[len(records)-1]
+		switch policy {
+		case "oldest", "all", "none":
+			kept = records[0]
+		}
+		keptRecords[key] = kept
+		keptID := iToS(kept["h_pk_asset_id"])
+		switch policy {
+		case "all":
+			for _, record := range records {
+				if iToS(record["h_pk_asset_id"]) != keptID {
+					duplicateAssets[keptID] = append(duplicateAssets[keptID], record)
+				}
+			}
+		case "none":
+			duplicateSkippedAssets[keptID] = true
+		}
+
+		var assetIDs []string
+		for _, record := range records {
+			assetID := iToS(record["h_pk_asset_id"])
+			assetIDs = append(assetIDs, assetID)
+			reportRows = append(reportRows, []string{assetType.AssetType, keyName, strings.Replace(key, "\x1f", "+", -1), assetID, iToS(record["h_name"]), getDuplicateAction(policy, assetID, keptID)})
+		}
+		logger(5, "[DUPLICATE] "+strconv.Itoa(len(records))+" "+assetType.AssetType+" assets have "+keyName+" ["+strings.Replace(key, "\x1f", "+", -1)+"]: "+strings.Join(assetIDs, ", "), false, true)
+	}
+	mutexCounters.Lock()
+	counters.duplicates += uint32(len(duplicates))
+	mutexCounters.Unlock()
+	logger(5, "[DUPLICATE] "+strconv.Itoa(len(duplicates))+" groups of duplicate "+assetType.AssetType+" assets found in Hornbill", true, true)
+
+	if err := writeDuplicateReport(reportRows); err != nil {
+		logger(4, "[DUPLICATE] Unable to write duplicates report: "+err.Error(), true, true)
+	}
+	return keptRecords
+}
+
+func getDuplicateAction(policy, assetID, keptID string) string {
+	switch {
+	case policy == "none":
+		return "Skipped"
+	case policy == "all":
+		return "Updated"
+	case assetID == keptID:
+		return "Updated"
+	}
+	return "Ignored"
+}
+
+// comparePrimaryKeys -- returns true if asset primary key a is lower than b, comparing numerically where possible
+func comparePrimaryKeys(a, b string) bool {
+	intA, errA := strconv.Atoi(a)
+	intB, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return intA < intB
+	}
+	return a < b
+}
+
+// writeDuplicateReport -- appends duplicate asset groups to a CSV report in the log folder, named after the run
+func writeDuplicateReport(rows [][]string) error {
+	cwd, _ := os.Getwd()
+	reportFileName := cwd + "/log/Asset_Duplicates_" + startTime.Format("20060102150405") + ".csv"
+	_, statErr := os.Stat(reportFileName)
+	newReport := os.IsNotExist(statErr)
+
+	f, err := os.OpenFile(reportFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if newReport {
+		w.Write([]string{"AssetType", "EntityColumn", "Value", "AssetID", "Name", "Action"})
+	}
+	w.WriteAll(rows)
+	if err := w.Error(); err != nil {
+		return err
+	}
+	logger(1, "[DUPLICATE] Duplicates report written to "+reportFileName, true, false)
+	return nil
+}
+
+// getDuplicateAssets -- returns the other Hornbill assets to update along with a matched asset, when DuplicatePolicy is All
+func getDuplicateAssets(hbRecord map[string]interface{}) []map[string]interface{} {
+	return duplicateAssets[iToS(hbRecord["h_pk_asset_id"])]
+}
+
+// isDuplicateSkipped -- returns true if a matched asset has duplicates, and DuplicatePolicy is None
+func isDuplicateSkipped(hbRecord map[string]interface{}) bool {
+	return duplicateSkippedAssets[iToS(hbRecord["h_pk_asset_id"])]
+}
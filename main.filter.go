@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkFilters -- validates the Filters configured against each asset type
+func checkFilters() error {
+	for _, v := range SQLImportConf.AssetTypes {
+		for i, f := range v.Filters {
+			ruleName := v.AssetType + " filter " + strconv.Itoa(i+1)
+			if !strings.EqualFold(f.Type, "include") && !strings.EqualFold(f.Type, "exclude") {
+				return errors.New(ruleName + ": Type must be Include or Exclude")
+			}
+			if f.Column == "" {
+				return errors.New(ruleName + ": Column not set")
+			}
+			switch strings.ToLower(f.Operator) {
+			case "equals", "empty":
+			case "regex":
+				if _, err := exprRegex(f.Value); err != nil {
+					return errors.New(ruleName + ": invalid regular expression: " + err.Error())
+				}
+			case "olderthandays":
+				if _, err := strconv.Atoi(f.Value); err != nil {
+					return errors.New(ruleName + ": Value must be a number of days")
+				}
+			default:
+				return errors.New(ruleName + ": Operator must be Equals, Regex, Empty or OlderThanDays")
+			}
+		}
+	}
+	return nil
+}
+
+// filterAssets -- removes records that are excluded by the Filters of the asset type, logging the rule that matched
+func filterAssets(arrAssets map[string]map[string]interface{}, assetType assetTypesStruct) map[string]map[string]interface{} {
+	if len(assetType.Filters) == 0 {
+		return arrAssets
+	}
+	filteredAssets := make(map[string]map[string]interface{})
+	for assetID, assetRecord := range arrAssets {
+		if reason := filterRecord(assetRecord, assetType.Filters); reason != "" {
+			mutexCounters.Lock()
+			counters.filtered++
+			mutexCounters.Unlock()
+			logger(1, "[FILTER] Asset "+assetID+" filtered out: "+reason, false, false)
+			continue
+		}
+		filteredAssets[assetID] = assetRecord
+	}
+	logger(3, "[FILTER] "+strconv.Itoa(len(arrAssets)-len(filteredAssets))+" of "+strconv.Itoa(len(arrAssets))+" "+assetType.AssetType+" records filtered out", true, true)
+	return filteredAssets
+}
+
+// filterRecord -- returns a description of the rule that excludes the record, or an empty string if the record is included
+// A record is excluded if it matches any Exclude rule, or does not match every Include rule
+func filterRecord(u map[string]interface{}, filters []filterStruct) string {
+	for _, f := range filters {
+		matched := filterMatch(u, f)
+		if strings.EqualFold(f.Type, "exclude") && matched {
+			return "matched Exclude rule " + f.Column + " " + f.Operator + " " + f.Value
+		}
+		if strings.EqualFold(f.Type, "include") && !matched {
+			return "did not match Include rule " + f.Column + " " + f.Operator + " " + f.Value
+		}
+	}
+	return ""
+}
+
+func filterMatch(u map[string]interface{}, f filterStruct) bool {
+	value := iToS(u[f.Column])
+	switch strings.ToLower(f.Operator) {
+	case "equals":
+		return strings.EqualFold(value, f.Value)
+	case "empty":
+		return strings.TrimSpace(value) == ""
+	case "regex":
+		re, err := exprRegex(f.Value)
+		return err == nil && re.MatchString(value)
+	case "olderthandays":
+		days, _ := strconv.Atoi(f.Value)
+		recordDate, ok := u[f.Column].(time.Time)
+		if !ok {
+			var err error
+			recordDate, err = parseDate(strings.TrimSpace(value), SQLImportConf.DateConf.InputFormats, getDateLocation(SQLImportConf.DateConf.Timezone))
+			if err != nil {
+				return false
+			}
+		}
+		return recordDate.Before(time.Now().AddDate(0, 0, -days))
+	}
+	return false
+}
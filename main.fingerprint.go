@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+// checkForceFlag -- validates the value passed to the -force flag, and the flags it cannot be combined with
+func checkForceFlag() error {
+	switch strings.ToLower(configForce) {
+	case "", "records", "software", "all":
+	default:
+		return errors.New("Invalid -force value [" + configForce + "], should be records, software or all")
+	}
+	if configForce != "" && configRehashOnly {
+		return errors.New("The -force and -rehash-only flags cannot be used together")
+	}
+	if configPlan && configRehashOnly {
+		return errors.New("The -plan and -rehash-only flags cannot be used together")
+	}
+	if configApply != "" && (configPlan || configRehashOnly || configForce != "") {
+		return errors.New("The -apply flag cannot be used with -plan, -rehash-only or -force")
+	}
+	return nil
+}
+
+// forceRecords -- returns true if asset record fingerprints should be ignored, so every matched asset is updated
+func forceRecords() bool {
+	return strings.EqualFold(configForce, "records") || strings.EqualFold(configForce, "all")
+}
+
+// forceSoftware -- returns true if software inventory fingerprints should be ignored, so every asset's software inventory is synced
+func forceSoftware() bool {
+	return strings.EqualFold(configForce, "software") || strings.EqualFold(configForce, "all")
+}
+
+// rehashAsset -- stores the record and software inventory fingerprints against an existing asset, without changing any other fields
+// Only fingerprints that differ from the cached Hornbill record are written
+func rehashAsset(strAssetID string, assetType assetTypesStruct, hbRecord map[string]interface{}, recordHash, softwareRecordsHash string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	fingerprints := []assetFieldStruct{{Field: getFingerprintColumn(assetType.Class), Value: recordHash}}
+	if softwareRecordsHash != "" && (assetType.Class == "computer" || assetType.Class == "mobileDevice") {
+		fingerprints = append(fingerprints, assetFieldStruct{Field: "h_dsc_sw_fingerprint", Value: softwareRecordsHash})
+	}
+	changes := getFieldChanges(getClassEntity(assetType.Class), fingerprints, hbRecord)
+	if len(changes) == 0 {
+		buffer.WriteString(loggerGen(1, "Asset fingerprints are up to date, no rehash required"))
+		mutexCounters.Lock()
+		counters.rehashSkipped++
+		mutexCounters.Unlock()
+		return
+	}
+
+	setAssetUpdateParams(strAssetID, nil, changes, espXmlmc)
+	XMLSTRING := espXmlmc.GetParam()
+	if configDryRun {
+		buffer.WriteString(loggerGen(1, "Asset Rehash XML "+XMLSTRING))
+		espXmlmc.ClearParam()
+		mutexCounters.Lock()
+		counters.rehashSkipped++
+		mutexCounters.Unlock()
+		return
+	}
+	debugLog(buffer, "Asset Rehash XML:", XMLSTRING)
+
+	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		buffer.WriteString(loggerGen(4, "API Call failed when storing Asset fingerprints:"+xmlmcErr.Error()))
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		mutexCounters.Lock()
+		counters.rehashFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	var xmlRespon xmlmcUpdateResponse
+	err := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance when storing Asset fingerprints:"+err.Error()))
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		mutexCounters.Lock()
+		counters.rehashFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(4, "Unable to store Asset fingerprints: "+xmlRespon.State.ErrorRet))
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		mutexCounters.Lock()
+		counters.rehashFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	buffer.WriteString(loggerGen(1, "Asset fingerprints stored successfully: "+strAssetID))
+	journalAssetChanges("Update", strAssetID, changes, buffer)
+	mutexCounters.Lock()
+	counters.rehashed++
+	mutexCounters.Unlock()
+}
@@ -3,6 +3,7 @@ package main
 //----- Packages -----
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -31,6 +32,13 @@ func main() {
 	flag.BoolVar(&configDryRun, "dryrun", false, "Allow the Import to run without Creating or Updating Assets")
 	flag.StringVar(&configMaxRoutines, "concurrent", "1", "Maximum number of Assets to import concurrently.")
 	flag.BoolVar(&configVersion, "version", false, "Return version and end")
+	flag.StringVar(&configTestScript, "testscript", "", "Name of a JSON file of sample rows to run the configured Script against, then end")
+	flag.StringVar(&configForce, "force", "", "Ignore fingerprints and sync every matched asset: records, software or all")
+	flag.BoolVar(&configRehashOnly, "rehash-only", false, "Recompute and store asset fingerprints without updating any other fields")
+	flag.BoolVar(&configIgnoreThresholds, "override-thresholds", false, "Continue the import when the mass-change thresholds of an asset type are breached")
+	flag.BoolVar(&configPlan, "plan", false, "Write a plan of the changes the import would make, without making any changes")
+	flag.StringVar(&configRollback, "rollback", "", "ID of a previous run to roll back the journaled changes of, instead of querying the source")
+	flag.StringVar(&configApply, "apply", "", "Name of a JSON plan file written by -plan, to make the changes in instead of querying the source")
 	flag.Parse()
 
 	//-- If configVersion just output version number and die
@@ -40,8 +48,21 @@ func main() {
 	}
 
 	//--
+	//-- Plan mode never makes changes
+	if configPlan {
+		configDryRun = true
+	}
+
 	//-- Load Configuration File Into Struct
 	SQLImportConf = loadConfig()
+
+	//-- If configTestScript just run the script against the sample rows and die
+	if configTestScript != "" {
+		if !testScript(configTestScript) {
+			os.Exit(1)
+		}
+		return
+	}
 	if SQLImportConf.LogSizeBytes > 0 {
 		maxLogFileSize = SQLImportConf.LogSizeBytes
 	}
@@ -54,6 +75,37 @@ func main() {
 	logger(1, "Flag - Config File "+configFileName, true, true)
 	logger(1, "Flag - Dry Run "+fmt.Sprintf("%v", configDryRun), true, true)
 	logger(1, "Flag - Concurrent "+configMaxRoutines, true, true)
+	if configForce != "" {
+		logger(1, "Flag - Force "+configForce, true, true)
+	}
+	if configIgnoreThresholds {
+		logger(1, "Flag - Override Thresholds "+fmt.Sprintf("%v", configIgnoreThresholds), true, true)
+	}
+	if configPlan {
+		logger(1, "Flag - Plan "+fmt.Sprintf("%v", configPlan), true, true)
+	}
+	if configRehashOnly {
+		logger(1, "Flag - Rehash Only "+fmt.Sprintf("%v", configRehashOnly), true, true)
+	}
+	if configApply != "" {
+		logger(1, "Flag - Apply "+configApply, true, true)
+	}
+	if configRollback != "" {
+		logger(1, "Flag - Rollback "+configRollback, true, true)
+	}
+	logger(1, "Run ID "+getRunID(), true, true)
+
+	//Check force & rehash flags
+	err := checkForceFlag()
+	if err != nil {
+		color.Red(err.Error())
+		return
+	}
+	err = checkRollbackFlag()
+	if err != nil {
+		color.Red(err.Error())
+		return
+	}
 
 	//Check maxGoroutines for valid value
 	maxRoutines, err := strconv.Atoi(configMaxRoutines)
@@ -70,6 +122,72 @@ func main() {
 		return
 	}
 
+	//Load source date formats & timezones
+	err = loadDateConf()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Check record filters
+	err = checkFilters()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Check field mapping modes
+	err = checkFieldModes()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Check asset match rules
+	err = checkMatchRules()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Check duplicate asset policy
+	err = checkDuplicatePolicy()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Check missing asset policies
+	err = checkMissingAssetsConf()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Check asset relationship queries
+	err = checkRelationshipsConf()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Check software inventory removal settings
+	err = checkSoftwareRemovalConf()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
+	//Fingerprint of the mapping configuration, included in each asset fingerprint
+	mappingHash = getMappingHash()
+
+	//Load per-record transform script
+	err = loadScript()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
 	//Set SWSQLDriver to mysql320
 	if SQLImportConf.SQLConf.Driver == "swsql" {
 		SQLImportConf.SQLConf.Driver = "mysql320"
@@ -77,6 +195,13 @@ func main() {
 
 	processCaching()
 
+	//Check generic field mapping against the Asset entity schema
+	err = checkMappingSchema("Asset", SQLImportConf.AssetGenericFieldMapping)
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return
+	}
+
 	//Build DB connection string
 	connString = buildConnectionString()
 	if connString == "" {
@@ -86,36 +211,33 @@ func main() {
 
 	//Get asset types, process accordingly
 	BaseSQLQuery = SQLImportConf.SQLConf.Query
-	for _, v := range SQLImportConf.AssetTypes {
-		StrAssetType = fmt.Sprintf("%v", v.AssetType)
-		StrSQLAppend = fmt.Sprintf("%v", v.Query)
-		//Set Asset Class & Type vars from instance
-		AssetClass, AssetTypeID = getAssetClass(StrAssetType)
-		v.TypeID = AssetTypeID
-		v.Class = AssetClass
-		debugLog(nil, "Asset Type and Class:", StrAssetType, strconv.Itoa(AssetTypeID), AssetClass)
-
-		//-- Query Database
-		var boolSQLAssets, arrAssets = queryAssets(StrSQLAppend, v)
-		if boolSQLAssets && len(arrAssets) > 0 {
-			//Cache instance asset records of class & type
-			logger(1, "Caching "+v.AssetType+" Asset Records from Hornbill...", true, true)
-			assetCount, err := getAssetCount(v, hornbillImport)
-			if err != nil {
-				logger(4, "Unable to count asset records: "+err.Error(), true, true)
-				continue
-			}
-			var assetCache map[string]map[string]interface{}
-			if assetCount > 0 {
-				assetCache, err = getAssetRecords(assetCount, v, hornbillImport)
-				if err != nil {
-					logger(4, "Unable to cache asset records: "+err.Error(), true, true)
-					continue
+	if configApply != "" {
+		applyPlan(configApply)
+	} else if configRollback != "" {
+		rollbackRun(configRollback)
+	} else {
+		loadTypeCaches()
+		if SQLImportConf.AssetTypeRouting.Column != "" {
+			processRoutedAssetTypes()
+		} else {
+			var assetTypes []preparedAssetTypeStruct
+			for _, v := range SQLImportConf.AssetTypes {
+				StrSQLAppend = fmt.Sprintf("%v", v.Query)
+				v = setAssetType(v)
+
+				//-- Query Database
+				var boolSQLAssets, arrAssets = queryAssets(StrSQLAppend, v)
+				if boolSQLAssets {
+					assetTypes = append(assetTypes, prepareAssetType(arrAssets, v))
 				}
 			}
-			//Process records returned by query & cache
-			processAssets(arrAssets, assetCache, v)
+			processAssetTypes(assetTypes)
 		}
+		processPendingMissingAssets()
+		processRelationships()
+	}
+	if configPlan {
+		writePlan()
 	}
 
 	//-- End output
@@ -127,17 +249,161 @@ func main() {
 	logger(1, "Update Failed: "+fmt.Sprintf("%d", counters.updateFailed), true, true)
 	logger(1, "Update Extended Record Skipped: "+fmt.Sprintf("%d", counters.updateRelatedSkipped), true, true)
 	logger(1, "Update Extended Record Failed: "+fmt.Sprintf("%d", counters.updateRelatedFailed), true, true)
+	if SQLImportConf.AssetTypeRouting.Column != "" {
+		logger(1, "Unrouted Records: "+fmt.Sprintf("%d", counters.unrouted), true, true)
+	}
+	logger(1, "Filtered Out: "+fmt.Sprintf("%d", counters.filtered), true, true)
+	logger(1, "Duplicate Asset Groups: "+fmt.Sprintf("%d", counters.duplicates), true, true)
+	if strings.EqualFold(SQLImportConf.DuplicatePolicy, "none") {
+		logger(1, "Duplicate Assets Skipped: "+fmt.Sprintf("%d", counters.duplicateSkipped), true, true)
+	}
+	if SQLImportConf.DetectTypeChanges {
+		logger(1, "Assets Reclassified: "+fmt.Sprintf("%d", counters.moved), true, true)
+		logger(1, "Assets Reclassify Failed: "+fmt.Sprintf("%d", counters.moveFailed), true, true)
+	}
+	if missingAssetsConfigured() {
+		logger(1, "Missing Assets Actioned: "+fmt.Sprintf("%d", counters.retired), true, true)
+		logger(1, "Missing Assets Skipped: "+fmt.Sprintf("%d", counters.retireSkipped), true, true)
+		logger(1, "Missing Assets Failed: "+fmt.Sprintf("%d", counters.retireFailed), true, true)
+	}
+	if configRollback != "" {
+		logger(1, "Changes Rolled Back: "+fmt.Sprintf("%d", counters.rolledBack), true, true)
+		logger(1, "Changes Rollback Failed: "+fmt.Sprintf("%d", counters.rollbackFailed), true, true)
+	}
+	if configApply != "" {
+		logger(1, "Plan Changes Refused: "+fmt.Sprintf("%d", counters.applyRefused), true, true)
+	}
+	if SQLImportConf.Timeline.Enabled {
+		logger(1, "Timeline Posts: "+fmt.Sprintf("%d", counters.timelinePosted), true, true)
+		logger(1, "Timeline Posts Failed: "+fmt.Sprintf("%d", counters.timelineFailed), true, true)
+	}
+	if relationshipsConfigured() {
+		logger(1, "Relationships Created: "+fmt.Sprintf("%d", counters.linksCreated), true, true)
+		logger(1, "Relationships Skipped: "+fmt.Sprintf("%d", counters.linksSkipped), true, true)
+		logger(1, "Relationships Failed: "+fmt.Sprintf("%d", counters.linksFailed), true, true)
+		logger(1, "Relationships Unresolved: "+fmt.Sprintf("%d", counters.linksUnresolved), true, true)
+	}
+	if configRehashOnly {
+		logger(1, "Fingerprints Stored: "+fmt.Sprintf("%d", counters.rehashed), true, true)
+		logger(1, "Fingerprints Up To Date: "+fmt.Sprintf("%d", counters.rehashSkipped), true, true)
+		logger(1, "Fingerprints Failed: "+fmt.Sprintf("%d", counters.rehashFailed), true, true)
+	}
+	if scriptGlobals != nil {
+		logger(1, "Script Skipped: "+fmt.Sprintf("%d", counters.scriptSkipped), true, true)
+		logger(1, "Script Failed: "+fmt.Sprintf("%d", counters.scriptFailed), true, true)
+	}
 	logger(1, "Assets Software Inventory Skipped: "+fmt.Sprintf("%d", counters.softwareSkipped), true, true)
 	logger(1, "Software Records Created: "+fmt.Sprintf("%d", counters.softwareCreated), true, true)
 	logger(1, "Software Records Create Failed: "+fmt.Sprintf("%d", counters.softwareCreateFailed), true, true)
 	logger(1, "Software Records Removed: "+fmt.Sprintf("%d", counters.softwareRemoved), true, true)
 	logger(1, "Software Records Removal Failed: "+fmt.Sprintf("%d", counters.softwareRemoveFailed), true, true)
+	if softRemovalConfigured() {
+		logger(1, "Software Records Marked Removed: "+fmt.Sprintf("%d", counters.softwareSoftRemoved), true, true)
+		logger(1, "Software Records Restored: "+fmt.Sprintf("%d", counters.softwareRestored), true, true)
+		logger(1, "Software Records Purged: "+fmt.Sprintf("%d", counters.softwarePurged), true, true)
+	}
+	if softwareSafeguardConfigured() {
+		logger(1, "Software Removals Skipped By Safeguard: "+fmt.Sprintf("%d", counters.softwareGuarded), true, true)
+	}
 
 	//-- Show Time Takens
 	logger(1, "Time Taken: "+fmt.Sprintf("%v", time.Since(startTime).Round(time.Second)), true, true)
 	logger(1, "---- XMLMC Database Asset Import Complete ---- ", true, true)
 }
 
+//setAssetType -- Sets the Asset Class & Type vars for the asset type about to be processed
+func setAssetType(v assetTypesStruct) assetTypesStruct {
+	StrAssetType = fmt.Sprintf("%v", v.AssetType)
+	//Set Asset Class & Type vars from instance
+	AssetClass, AssetTypeID = getAssetClass(StrAssetType)
+	v.TypeID = AssetTypeID
+	v.Class = AssetClass
+	debugLog(nil, "Asset Type and Class:", StrAssetType, strconv.Itoa(AssetTypeID), AssetClass)
+	return v
+}
+
+//prepareAssetType -- Checks the type field mapping of an asset type, caches its Hornbill records and filters its source records, ready for processing
+//Asset types whose query returned no records are not cached or processed, but are still checked against their thresholds
+func prepareAssetType(arrAssets map[string]map[string]interface{}, v assetTypesStruct) preparedAssetTypeStruct {
+	prepared := preparedAssetTypeStruct{AssetType: v, ArrAssets: arrAssets}
+	if len(arrAssets) == 0 {
+		return prepared
+	}
+
+	//Check type field mapping against the class entity schema
+	err := checkMappingSchema(getClassEntity(v.Class), SQLImportConf.AssetTypeFieldMapping)
+	if err != nil {
+		logger(4, err.Error()+". "+v.AssetType+" assets will not be processed.", true, true)
+		return prepared
+	}
+
+	//Cache instance asset records of class & type
+	assetCache, ok := getTypeCache(v)
+	if !ok {
+		assetCache, err = cacheAssetType(v)
+		if err != nil {
+			logger(4, err.Error(), true, true)
+			return prepared
+		}
+	}
+	prepared.AssetCache = assetCache
+
+	//Filter the records once, the filtered set is used by both the threshold checks and processing
+	prepared.SourceAssets = filterAssets(arrAssets, v)
+	prepared.Ready = true
+	return prepared
+}
+
+//processAssetTypes -- Checks the mass-change thresholds of every asset type before any of them are processed,
+//then processes each asset type in turn
+func processAssetTypes(assetTypes []preparedAssetTypeStruct) {
+	enforceThresholds(assetTypes)
+	for _, prepared := range assetTypes {
+		if prepared.Ready {
+			processAssetType(prepared)
+		}
+	}
+}
+
+//processAssetType -- Processes the source records of an asset type against its cached Hornbill records
+func processAssetType(prepared preparedAssetTypeStruct) {
+	v := prepared.AssetType
+	setAssetTypeGlobals(v)
+	assetMatchIndexes = buildMatchIndexes(prepared.AssetCache, v)
+
+	//Process records returned by query & cache
+	processAssets(prepared.SourceAssets, prepared.AssetCache, v)
+
+	//Retire or archive Hornbill assets that are no longer returned by the source
+	if !deferMissingAssets(prepared.ArrAssets, prepared.AssetCache, v) {
+		processMissingAssets(prepared.ArrAssets, prepared.AssetCache, v)
+	}
+}
+
+//setAssetTypeGlobals -- Sets the Asset Class & Type vars from an asset type that has already been resolved by setAssetType
+func setAssetTypeGlobals(v assetTypesStruct) {
+	StrAssetType = v.AssetType
+	AssetClass = v.Class
+	AssetTypeID = v.TypeID
+}
+
+//cacheAssetType -- Caches the Hornbill asset records of an asset type
+func cacheAssetType(v assetTypesStruct) (map[string]map[string]interface{}, error) {
+	logger(1, "Caching "+v.AssetType+" Asset Records from Hornbill...", true, true)
+	assetCount, err := getAssetCount(v, hornbillImport)
+	if err != nil {
+		return nil, errors.New("Unable to count asset records: " + err.Error())
+	}
+	var assetCache map[string]map[string]interface{}
+	if assetCount > 0 {
+		assetCache, err = getAssetRecords(assetCount, v, hornbillImport)
+		if err != nil {
+			return nil, errors.New("Unable to cache asset records: " + err.Error())
+		}
+	}
+	return assetCache, nil
+}
+
 //loadConfig -- Function to Load Configruation File
 func loadConfig() sqlImportConfStruct {
 	//-- Check Config File File Exists
@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"strconv"
 	"strings"
 
@@ -135,7 +134,7 @@ func getGroupID(u map[string]interface{}, groupType string, buffer *bytes.Buffer
 		groupTypeID = 5
 		groupCol = "h_company_name"
 	}
-	groupNameMapping := fmt.Sprintf("%v", SQLImportConf.AssetGenericFieldMapping[groupCol])
+	groupNameMapping := getFieldMapping(groupCol, SQLImportConf.AssetGenericFieldMapping[groupCol], u, buffer)
 	groupName = getFieldValue(groupCol, groupNameMapping, u, buffer)
 	if groupName != "" && groupName != "<nil>" && groupName != "__clear__" {
 		//-- Check if group is in Cache
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- Run journal
+//-- Every change a run makes in Hornbill is written to a journal in the log folder, named after the run ID: the previous
+//-- values of each field changed, the assets created, and the software inventory records added and deleted.
+//-- The -rollback flag reads the journal of a run, and reverts its changes in reverse order
+
+type journalEntryStruct struct {
+	Time     string
+	Action   string
+	AssetID  string
+	Entity   string                   `json:",omitempty"`
+	Changes  []assetFieldChangeStruct `json:",omitempty"`
+	RecordID int                      `json:",omitempty"`
+	Record   map[string]string        `json:",omitempty"`
+}
+
+// getRunID -- returns the ID of this run, used to name its log files and journal
+func getRunID() string {
+	return startTime.Format("20060102150405")
+}
+
+// getJournalFileName -- returns the path of the journal of a run
+func getJournalFileName(runID string) string {
+	cwd, _ := os.Getwd()
+	return cwd + "/log/Asset_Journal_" + runID + ".json"
+}
+
+// journalEnabled -- returns true if the changes of this run should be journaled
+// Nothing is journaled in dry run mode, as no changes are made, or when rolling back a run
+func journalEnabled() bool {
+	return !configDryRun && configRollback == ""
+}
+
+// writeJournal -- appends an entry to the journal of this run
+func writeJournal(entry journalEntryStruct, buffer *bytes.Buffer) {
+	addTimelineChanges(entry)
+	if !journalEnabled() {
+		return
+	}
+	entry.Time = time.Now().Format("2006-01-02 15:04:05")
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "[JOURNAL] Unable to encode journal entry: "+err.Error()))
+		return
+	}
+	mutexJournal.Lock()
+	defer mutexJournal.Unlock()
+	f, err := os.OpenFile(getJournalFileName(getRunID()), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "[JOURNAL] Unable to open journal: "+err.Error()))
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(entryJSON, '\n')); err != nil {
+		buffer.WriteString(loggerGen(4, "[JOURNAL] Unable to write journal entry: "+err.Error()))
+	}
+}
+
+// journalAssetChanges -- journals the field changes made to an asset, along with their previous values
+// The last updated fields are not journaled, as they are set again when a change is rolled back
+func journalAssetChanges(action string, strAssetID string, changes []assetFieldChangeStruct, buffer *bytes.Buffer) {
+	var journalChanges []assetFieldChangeStruct
+	for _, change := range changes {
+		if change.Field != "h_last_updated" && change.Field != "h_last_updated_by" {
+			journalChanges = append(journalChanges, change)
+		}
+	}
+	if len(journalChanges) > 0 {
+		writeJournal(journalEntryStruct{Action: action, AssetID: strAssetID, Changes: journalChanges}, buffer)
+	}
+}
+
+// getSoftwareInventoryRecord -- reads the column values of a software inventory record, so it can be journaled before it is deleted
+func getSoftwareInventoryRecord(pkid int, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (map[string]string, error) {
+	return getEntityRecord("AssetsInstalledSoftware", strconv.Itoa(pkid), espXmlmc, buffer)
+}
+
+// getEntityRecord -- reads the column values of a Service Manager entity record
+func getEntityRecord(entity string, keyValue string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (map[string]string, error) {
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", entity)
+	espXmlmc.SetParam("keyValue", keyValue)
+	XMLSTRING := espXmlmc.GetParam()
+	debugLog(buffer, entity+" Record Get XML:", XMLSTRING)
+	XMLRecord, xmlmcErr := espXmlmc.Invoke("data", "entityGetRecord")
+	if xmlmcErr != nil {
+		return nil, errors.New("API Call failed when reading " + entity + " record:" + xmlmcErr.Error())
+	}
+	var xmlRespon xmlmcUpdateResponse
+	err := xml.Unmarshal([]byte(XMLRecord), &xmlRespon)
+	if err != nil {
+		return nil, errors.New("Unable to read response from Hornbill instance when reading " + entity + " record:" + err.Error())
+	}
+	if xmlRespon.MethodResult != "ok" {
+		return nil, errors.New("Unable to read " + entity + " record: " + xmlRespon.State.ErrorRet)
+	}
+	record := make(map[string]string)
+	for _, col := range xmlRespon.UpdatedCols.ColList {
+		record[col.XMLName.Local] = col.Amount
+	}
+	return record, nil
+}
+
+// checkRollbackFlag -- validates the flags that -rollback cannot be combined with
+func checkRollbackFlag() error {
+	if configRollback != "" && (configPlan || configRehashOnly || configForce != "" || configApply != "") {
+		return errors.New("The -rollback flag cannot be used with -plan, -rehash-only, -force or -apply")
+	}
+	return nil
+}
+
+// loadJournal -- reads the journal of a run
+func loadJournal(runID string) (entries []journalEntryStruct, err error) {
+	file, err := os.Open(getJournalFileName(runID))
+	if err != nil {
+		return nil, errors.New("Unable to open journal of run " + runID + ": " + err.Error())
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry journalEntryStruct
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.New("Unable to read journal of run " + runID + ": " + err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.New("Unable to read journal of run " + runID + ": " + err.Error())
+	}
+	return entries, nil
+}
+
+// rollbackRun -- reverts the changes journaled by a run, newest first
+func rollbackRun(runID string) {
+	entries, err := loadJournal(runID)
+	if err != nil {
+		logger(4, "[ROLLBACK] "+err.Error(), true, true)
+		return
+	}
+	logger(1, "[ROLLBACK] Rolling back "+strconv.Itoa(len(entries))+" changes made by run "+runID, true, true)
+
+	espXmlmc := apiLib.NewXmlmcInstance(SQLImportConf.InstanceID)
+	espXmlmc.SetAPIKey(SQLImportConf.APIKey)
+	softwareReverted := make(map[string]bool)
+	deletedAssets := make(map[string]bool)
+	for i := len(entries) - 1; i >= 0; i-- {
+		var buffer bytes.Buffer
+		entry := entries[i]
+		buffer.WriteString(loggerGen(1, "[ROLLBACK] "+entry.Action+" of Asset "+entry.AssetID+" at "+entry.Time))
+		err := rollbackEntry(entry, espXmlmc, &buffer)
+		mutexCounters.Lock()
+		if err != nil {
+			buffer.WriteString(loggerGen(4, "[ROLLBACK] Unable to roll back "+entry.Action+" of Asset "+entry.AssetID+": "+err.Error()))
+			counters.rollbackFailed++
+		} else {
+			counters.rolledBack++
+		}
+		mutexCounters.Unlock()
+		switch {
+		case err != nil:
+		case strings.HasPrefix(entry.Action, "Software"):
+			softwareReverted[entry.AssetID] = true
+		case entry.Action == "Create":
+			deletedAssets[entry.AssetID] = true
+		}
+		loggerWriteBuffer(buffer.String())
+	}
+
+	//Clear the software fingerprint of assets whose software inventory was rolled back, so it is synced again on the next run
+	for assetID := range softwareReverted {
+		if deletedAssets[assetID] {
+			continue
+		}
+		var buffer bytes.Buffer
+		fingerprint := []assetFieldChangeStruct{{Field: "h_dsc_sw_fingerprint", Clear: true}}
+		setAssetUpdateParams(assetID, nil, fingerprint, espXmlmc)
+		if err := invokeEntityChange(espXmlmc, "entityUpdateRecord", "Asset Rollback", &buffer); err != nil {
+			buffer.WriteString(loggerGen(4, "[ROLLBACK] Unable to clear software fingerprint of Asset "+assetID+": "+err.Error()))
+		}
+		loggerWriteBuffer(buffer.String())
+	}
+}
+
+// rollbackEntry -- reverts a single journaled change
+func rollbackEntry(entry journalEntryStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	switch entry.Action {
+	case "Update":
+		return rollbackAssetChanges(entry, espXmlmc, buffer)
+	case "Reclassify":
+		return rollbackReclassify(entry, espXmlmc, buffer)
+	case "Create":
+		if entry.Entity != "" {
+			espXmlmc.SetParam("application", appServiceManager)
+			espXmlmc.SetParam("entity", entry.Entity)
+			espXmlmc.SetParam("keyValue", entry.AssetID)
+			if err := invokeEntityChange(espXmlmc, "entityDeleteRecord", "Asset Rollback", buffer); err != nil {
+				return err
+			}
+		}
+		espXmlmc.SetParam("application", appServiceManager)
+		espXmlmc.SetParam("entity", "Asset")
+		espXmlmc.SetParam("keyValue", entry.AssetID)
+		return invokeEntityChange(espXmlmc, "entityDeleteRecord", "Asset Rollback", buffer)
+	case "SoftwareAdd":
+		if configDryRun {
+			buffer.WriteString(loggerGen(1, "Software inventory record "+strconv.Itoa(entry.RecordID)+" delete skipped in dry run mode"))
+			return nil
+		}
+		return deleteSoftwareInventoryRecord(entry.RecordID, espXmlmc, buffer)
+	case "SoftwareDelete":
+		espXmlmc.SetParam("application", appServiceManager)
+		espXmlmc.SetParam("entity", "AssetsInstalledSoftware")
+		espXmlmc.OpenElement("primaryEntityData")
+		espXmlmc.OpenElement("record")
+		for k, v := range entry.Record {
+			if k != "h_pk_id" {
+				espXmlmc.SetParam(k, v)
+			}
+		}
+		espXmlmc.CloseElement("record")
+		espXmlmc.CloseElement("primaryEntityData")
+		return invokeEntityChange(espXmlmc, "entityAddRecord", "Software Record Rollback", buffer)
+	case "SoftwareRemove", "SoftwareRestore":
+		var reverts []assetFieldChangeStruct
+		for _, change := range entry.Changes {
+			buffer.WriteString(loggerGen(1, "[ROLLBACK] "+change.Entity+"."+change.Field+": "+strconv.Quote(change.NewValue)+" -> "+strconv.Quote(change.OldValue)))
+			reverts = append(reverts, assetFieldChangeStruct{Entity: change.Entity, Field: change.Field, OldValue: change.NewValue, NewValue: change.OldValue, Clear: change.OldValue == ""})
+		}
+		return updateSoftwareRecord(entry.RecordID, reverts, espXmlmc, buffer)
+	}
+	return errors.New("unknown journal action " + entry.Action)
+}
+
+// rollbackAssetChanges -- sets the fields changed against an asset back to their previous values
+// Fields whose current value is no longer the value set by the run have been changed since, so are not rolled back
+func rollbackAssetChanges(entry journalEntryStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	var (
+		primaryChanges, extendedChanges []assetFieldChangeStruct
+		drifted                         []string
+		currentRecords                  = make(map[string]map[string]string)
+	)
+	for _, change := range entry.Changes {
+		if change.NotCached {
+			buffer.WriteString(loggerGen(5, "[ROLLBACK] The previous value of "+change.Entity+"."+change.Field+" is not known, so it cannot be rolled back"))
+			continue
+		}
+		currentRecord, ok := currentRecords[change.Entity]
+		if !ok {
+			var err error
+			currentRecord, err = getEntityRecord(change.Entity, entry.AssetID, espXmlmc, buffer)
+			if err != nil {
+				return err
+			}
+			currentRecords[change.Entity] = currentRecord
+		}
+		currentValue, ok := currentRecord[change.Field]
+		if !ok || normaliseFieldValue(currentValue) != normaliseFieldValue(change.NewValue) {
+			buffer.WriteString(loggerGen(5, "[ROLLBACK] "+change.Entity+"."+change.Field+" was set to "+strconv.Quote(change.NewValue)+" by the run, and is now "+strconv.Quote(currentValue)+", so it will not be rolled back"))
+			drifted = append(drifted, change.Entity+"."+change.Field)
+			continue
+		}
+		buffer.WriteString(loggerGen(1, "[ROLLBACK] "+change.Entity+"."+change.Field+": "+strconv.Quote(change.NewValue)+" -> "+strconv.Quote(change.OldValue)))
+		revert := assetFieldChangeStruct{Entity: change.Entity, Field: change.Field, OldValue: change.NewValue, NewValue: change.OldValue, Clear: change.OldValue == ""}
+		if change.Entity == "Asset" {
+			primaryChanges = append(primaryChanges, revert)
+		} else {
+			extendedChanges = append(extendedChanges, revert)
+		}
+	}
+	if len(primaryChanges) > 0 || len(extendedChanges) > 0 {
+		primaryChanges = append(primaryChanges,
+			assetFieldChangeStruct{Entity: "Asset", Field: "h_last_updated", NewValue: time.Now().Format("2006-01-02 15:04:05")},
+			assetFieldChangeStruct{Entity: "Asset", Field: "h_last_updated_by", NewValue: "Import - Rollback"},
+		)
+		setAssetUpdateParams(entry.AssetID, primaryChanges, extendedChanges, espXmlmc)
+		if err := invokeEntityChange(espXmlmc, "entityUpdateRecord", "Asset Rollback", buffer); err != nil {
+			return err
+		}
+	}
+	if len(drifted) > 0 {
+		return errors.New("fields changed since the run were not rolled back: " + strings.Join(drifted, ", "))
+	}
+	return nil
+}
+
+// rollbackReclassify -- moves a reclassified asset back to its previous asset type and class
+// If the class was changed, the extended record of the previous class is recreated from the values journaled by the run.
+// Nothing is deleted, so the extended record of the class the asset was moved to is left in place
+func rollbackReclassify(entry journalEntryStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	currentRecord, err := getEntityRecord("Asset", entry.AssetID, espXmlmc, buffer)
+	if err != nil {
+		return err
+	}
+	var typeID, class string
+	for _, change := range entry.Changes {
+		if currentRecord[change.Field] != change.NewValue {
+			return errors.New("the asset has been moved to another type since the run, its " + change.Field + " is now " + strconv.Quote(currentRecord[change.Field]))
+		}
+		switch change.Field {
+		case "h_type":
+			typeID = change.OldValue
+		case "h_class":
+			class = change.OldValue
+		}
+	}
+	if typeID == "" || class == "" {
+		return errors.New("the previous asset type of the asset is not journaled")
+	}
+	if entry.Entity != "" && entry.Record == nil {
+		return errors.New("the " + entry.Entity + " extended record of the asset is not journaled")
+	}
+	buffer.WriteString(loggerGen(1, "[ROLLBACK] Asset type and class: "+typeID+" ("+class+")"))
+
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Asset")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_asset_id", entry.AssetID)
+	espXmlmc.SetParam("h_type", typeID)
+	espXmlmc.SetParam("h_class", class)
+	espXmlmc.SetParam("h_last_updated", time.Now().Format("2006-01-02 15:04:05"))
+	espXmlmc.SetParam("h_last_updated_by", "Import - Rollback")
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	if entry.Entity != "" {
+		var columns []string
+		for k, v := range entry.Record {
+			if k != "h_pk_asset_id" && k != "h_type" && v != "" {
+				columns = append(columns, k)
+			}
+		}
+		sort.Strings(columns)
+		espXmlmc.OpenElement("relatedEntityData")
+		espXmlmc.SetParam("relationshipName", "AssetClass")
+		espXmlmc.SetParam("entityAction", "insert")
+		espXmlmc.OpenElement("record")
+		espXmlmc.SetParam("h_type", typeID)
+		for _, k := range columns {
+			espXmlmc.SetParam(k, entry.Record[k])
+		}
+		espXmlmc.CloseElement("record")
+		espXmlmc.CloseElement("relatedEntityData")
+	}
+	return invokeEntityChange(espXmlmc, "entityUpdateRecord", "Asset Rollback", buffer)
+}
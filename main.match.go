@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Indexes of the Hornbill asset cache for the asset type being processed, one per match rule
+var assetMatchIndexes []assetMatchIndexStruct
+
+type assetMatchIndexStruct struct {
+	Rule  matchRuleStruct
+	Exact bool
+	Keys  map[string]string
+}
+
+// checkMatchRules -- validates the MatchRules configured against each asset type
+func checkMatchRules() error {
+	for _, v := range SQLImportConf.AssetTypes {
+		for i, rule := range v.AssetIdentifier.MatchRules {
+			ruleName := v.AssetType + " match rule " + strconv.Itoa(i+1)
+			if len(rule.Keys) == 0 {
+				return errors.New(ruleName + ": no Keys set")
+			}
+			for _, key := range rule.Keys {
+				if key.DBColumn == "" || key.EntityColumn == "" {
+					return errors.New(ruleName + ": each key needs a DBColumn and an EntityColumn")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// getMatchRules -- returns the ordered match rules of the asset type
+// If none are configured, the AssetIdentifier DBColumn and EntityColumn are used as a single exact match rule
+func getMatchRules(assetType assetTypesStruct) []matchRuleStruct {
+	if len(assetType.AssetIdentifier.MatchRules) > 0 {
+		return assetType.AssetIdentifier.MatchRules
+	}
+	return []matchRuleStruct{{
+		Name: "AssetIdentifier",
+		Keys: []matchKeyStruct{{DBColumn: assetType.AssetIdentifier.DBColumn, EntityColumn: assetType.AssetIdentifier.EntityColumn}},
+	}}
+}
+
+// getCacheKeyColumn -- returns the Hornbill column the asset cache is keyed on
+// When match rules are configured, assets can be matched on any column so the cache is keyed on the asset primary key
+func getCacheKeyColumn(assetType assetTypesStruct) string {
+	if len(assetType.AssetIdentifier.MatchRules) > 0 {
+		return "h_pk_asset_id"
+	}
+	return assetType.AssetIdentifier.EntityColumn
+}
+
+// resolveMatchRuleDuplicates -- finds Hornbill assets that share the key of a match rule, and applies the DuplicatePolicy
+// to each group. The records that are not kept are removed from the asset cache, which is keyed on the asset primary key
+// when match rules are configured, so each match rule key resolves to a single asset
+func resolveMatchRuleDuplicates(recordMap map[string]map[string]interface{}, assetType assetTypesStruct) {
+	for _, rule := range assetType.AssetIdentifier.MatchRules {
+		var cacheKeys []string
+		for cacheKey := range recordMap {
+			cacheKeys = append(cacheKeys, cacheKey)
+		}
+		sort.Slice(cacheKeys, func(i, j int) bool { return comparePrimaryKeys(cacheKeys[i], cacheKeys[j]) })
+
+		groups := make(map[string][]map[string]interface{})
+		for _, cacheKey := range cacheKeys {
+			if key, ok := getMatchKey(recordMap[cacheKey], rule, false, true); ok {
+				groups[key] = append(groups[key], recordMap[cacheKey])
+			}
+		}
+		duplicates := make(map[string][]map[string]interface{})
+		for key, records := range groups {
+			if len(records) > 1 {
+				duplicates[key] = records
+			}
+		}
+
+		for key, kept := range resolveDuplicateGroups(duplicates, getMatchRuleName(rule), assetType) {
+			keptID := iToS(kept["h_pk_asset_id"])
+			for _, record := range duplicates[key] {
+				assetID := iToS(record["h_pk_asset_id"])
+				if assetID == keptID {
+					continue
+				}
+				//A record kept by an earlier rule passes its own duplicates on to the record that replaces it
+				duplicateAssets[keptID] = append(duplicateAssets[keptID], duplicateAssets[assetID]...)
+				delete(duplicateAssets, assetID)
+				if duplicateSkippedAssets[assetID] {
+					duplicateSkippedAssets[keptID] = true
+					delete(duplicateSkippedAssets, assetID)
+				}
+				delete(recordMap, assetID)
+			}
+		}
+	}
+}
+
+// buildMatchIndexes -- indexes the Hornbill asset cache on the key of each match rule
+func buildMatchIndexes(assetsCache map[string]map[string]interface{}, assetType assetTypesStruct) (indexes []assetMatchIndexStruct) {
+	for _, rule := range getMatchRules(assetType) {
+		index := assetMatchIndexStruct{Rule: rule, Exact: len(assetType.AssetIdentifier.MatchRules) == 0, Keys: make(map[string]string)}
+		for cacheKey, asset := range assetsCache {
+			key, ok := getMatchKey(asset, rule, index.Exact, true)
+			if !ok {
+				continue
+			}
+			//Keys are unique once duplicates have been resolved, but keep the lowest asset ID so the result never depends on map order
+			if existing, exists := index.Keys[key]; !exists || comparePrimaryKeys(iToS(asset["h_pk_asset_id"]), iToS(assetsCache[existing]["h_pk_asset_id"])) {
+				index.Keys[key] = cacheKey
+			}
+		}
+		if len(assetType.AssetIdentifier.MatchRules) > 0 {
+			logger(1, "Match rule "+getMatchRuleName(rule)+": "+strconv.Itoa(len(index.Keys))+" "+assetType.AssetType+" assets indexed", false, false)
+		}
+		indexes = append(indexes, index)
+	}
+	return
+}
+
+// getMatchKey -- builds the key of a match rule from a source record, or from a Hornbill record if hornbill is true
+// Returns false if any of the key columns are empty, so the rule cannot be used for the record
+func getMatchKey(record map[string]interface{}, rule matchRuleStruct, exact bool, hornbill bool) (string, bool) {
+	var keyParts []string
+	for _, key := range rule.Keys {
+		column := key.DBColumn
+		if hornbill {
+			column = key.EntityColumn
+		}
+		value := iToS(record[column])
+		if !exact {
+			value = strings.ToLower(strings.TrimSpace(value))
+		}
+		if value == "" {
+			return "", false
+		}
+		keyParts = append(keyParts, value)
+	}
+	return strings.Join(keyParts, "\x1f"), true
+}
+
+// matchAsset -- checks a source record against each match rule in order, and returns the asset cache key of the
+// first Hornbill asset that matches, along with the name of the rule that matched
+func matchAsset(u map[string]interface{}) (cacheKey string, ruleName string) {
+	return matchAssetIndexes(u, assetMatchIndexes)
+}
+
+// matchAssetIndexes -- checks a source record against the match rule indexes of an asset cache
+func matchAssetIndexes(u map[string]interface{}, indexes []assetMatchIndexStruct) (cacheKey string, ruleName string) {
+	for _, index := range indexes {
+		key, ok := getMatchKey(u, index.Rule, index.Exact, false)
+		if !ok {
+			continue
+		}
+		if cacheKey, ok = index.Keys[key]; ok {
+			return cacheKey, getMatchRuleName(index.Rule)
+		}
+	}
+	return "", ""
+}
+
+func getMatchRuleName(rule matchRuleStruct) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	var columns []string
+	for _, key := range rule.Keys {
+		columns = append(columns, key.DBColumn+"="+key.EntityColumn)
+	}
+	return strings.Join(columns, "+")
+}
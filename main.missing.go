@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+// Hornbill record state of an archived asset
+const assetArchivedState = "2"
+
+// checkMissingAssetsConf -- validates the MissingAssets policy configured against each asset type
+func checkMissingAssetsConf() error {
+	for _, v := range SQLImportConf.AssetTypes {
+		policy := v.MissingAssets
+		switch strings.ToLower(policy.Action) {
+		case "", "archive":
+		case "retire":
+			if policy.RecordState == "" && policy.OperationalState == "" && policy.SubStateID == "" && !policy.SetRetiredDate {
+				return errors.New(v.AssetType + " MissingAssets: Retire action requires at least one of RecordState, OperationalState, SubStateID or SetRetiredDate")
+			}
+		default:
+			return errors.New(v.AssetType + " MissingAssets: Action must be Retire or Archive")
+		}
+	}
+	return nil
+}
+
+// getMissingAssets -- returns the cache keys of Hornbill assets that were not matched by any record returned by the source query
+// Records are matched after the transform script has run, as processAssets matches them. A record the script skips or fails
+// on is matched as returned by the source, so its asset is not treated as missing
+func getMissingAssets(arrAssets map[string]map[string]interface{}, assetsCache map[string]map[string]interface{}, assetType assetTypesStruct) []string {
+	scriptFunction := getScriptFunction(assetType)
+	matchedAssets := make(map[string]bool)
+	for _, assetRecord := range arrAssets {
+		if scriptFunction != "" {
+			var scriptBuffer bytes.Buffer
+			if newAssetRecord, skip, err := runScript(scriptFunction, assetRecord, &scriptBuffer); err == nil && !skip {
+				assetRecord = newAssetRecord
+			}
+		}
+		if cacheKey, _ := matchAsset(assetRecord); cacheKey != "" {
+			matchedAssets[cacheKey] = true
+		}
+	}
+	var missingAssets []string
+	for cacheKey, asset := range assetsCache {
+		if !matchedAssets[cacheKey] && !isMovedAsset(asset) {
+			missingAssets = append(missingAssets, cacheKey)
+		}
+	}
+	sort.Strings(missingAssets)
+	return missingAssets
+}
+
+// processMissingAssets -- applies the MissingAssets policy of the asset type to the Hornbill assets that have disappeared from the source
+func processMissingAssets(arrAssets map[string]map[string]interface{}, assetsCache map[string]map[string]interface{}, assetType assetTypesStruct) {
+	if assetType.MissingAssets.Action == "" || configRehashOnly {
+		return
+	}
+	missingAssets := getMissingAssets(arrAssets, assetsCache, assetType)
+	logger(3, "[MISSING] "+strconv.Itoa(len(missingAssets))+" "+assetType.AssetType+" assets in Hornbill were not returned by the source query", true, true)
+	if len(missingAssets) == 0 {
+		return
+	}
+
+	espXmlmc := apiLib.NewXmlmcInstance(SQLImportConf.InstanceID)
+	espXmlmc.SetAPIKey(SQLImportConf.APIKey)
+	for _, cacheKey := range missingAssets {
+		var buffer bytes.Buffer
+		buffer.WriteString(loggerGen(1, "    "))
+		buffer.WriteString(loggerGen(1, "Processing Missing Asset: "+cacheKey))
+		if configPlan {
+			planMissingAsset(assetsCache[cacheKey], assetType, &buffer)
+		} else {
+			retireAsset(assetsCache[cacheKey], assetType, espXmlmc, &buffer)
+		}
+		loggerWriteBuffer(buffer.String())
+	}
+}
+
+// getMissingAssetFields -- returns the primary fields the MissingAssets policy sets against an asset
+func getMissingAssetFields(policy missingAssetsStruct, hbRecord map[string]interface{}) (fields []assetFieldStruct) {
+	if strings.EqualFold(policy.Action, "archive") {
+		return append(fields, assetFieldStruct{Field: "h_record_state", Value: assetArchivedState})
+	}
+	if policy.RecordState != "" {
+		fields = append(fields, assetFieldStruct{Field: "h_record_state", Value: policy.RecordState})
+	}
+	if policy.OperationalState != "" {
+		fields = append(fields, assetFieldStruct{Field: "h_operational_state", Value: policy.OperationalState})
+	}
+	if policy.SubStateID != "" {
+		fields = append(fields, assetFieldStruct{Field: "h_substate_id", Value: policy.SubStateID})
+		fields = append(fields, assetFieldStruct{Field: "h_substate_name", Value: policy.SubStateName})
+	}
+	//The retired date is only set once, so it records when the asset first went missing
+	if policy.SetRetiredDate && iToS(hbRecord["h_actual_retired_date"]) == "" {
+		fields = append(fields, assetFieldStruct{Field: "h_actual_retired_date", Value: time.Now().UTC().Format(hornbillDateFormat)})
+	}
+	return
+}
+
+// retireAsset -- retires or archives a single Hornbill asset that is missing from the source
+func retireAsset(hbRecord map[string]interface{}, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	strAssetID := iToS(hbRecord["h_pk_asset_id"])
+	changes := getFieldChanges("Asset", getMissingAssetFields(assetType.MissingAssets, hbRecord), hbRecord)
+	if len(changes) == 0 {
+		buffer.WriteString(loggerGen(1, "Missing asset "+strAssetID+" has already been actioned, no update required"))
+		mutexCounters.Lock()
+		counters.retireSkipped++
+		mutexCounters.Unlock()
+		return
+	}
+	for _, change := range changes {
+		buffer.WriteString(loggerGen(1, "Missing asset "+strAssetID+" "+change.Field+": "+change.OldValue+" -> "+change.NewValue))
+	}
+	changes = append(changes,
+		assetFieldChangeStruct{Entity: "Asset", Field: "h_last_updated", NewValue: time.Now().Format("2006-01-02 15:04:05")},
+		assetFieldChangeStruct{Entity: "Asset", Field: "h_last_updated_by", NewValue: "Import - " + assetType.MissingAssets.Action},
+	)
+	setAssetUpdateParams(strAssetID, changes, nil, espXmlmc)
+	XMLSTRING := espXmlmc.GetParam()
+	if configDryRun {
+		buffer.WriteString(loggerGen(1, "Asset "+assetType.MissingAssets.Action+" XML "+XMLSTRING))
+		espXmlmc.ClearParam()
+		mutexCounters.Lock()
+		counters.retireSkipped++
+		mutexCounters.Unlock()
+		return
+	}
+	debugLog(buffer, "Asset "+assetType.MissingAssets.Action+" XML:", XMLSTRING)
+
+	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		buffer.WriteString(loggerGen(4, "API Call failed when actioning Missing Asset:"+xmlmcErr.Error()))
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		mutexCounters.Lock()
+		counters.retireFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	var xmlRespon xmlmcUpdateResponse
+	err := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance when actioning Missing Asset:"+err.Error()))
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		mutexCounters.Lock()
+		counters.retireFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(4, "Unable to action Missing Asset: "+xmlRespon.State.ErrorRet))
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		mutexCounters.Lock()
+		counters.retireFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	buffer.WriteString(loggerGen(1, "Missing Asset "+strings.ToLower(assetType.MissingAssets.Action)+"d successfully: "+strAssetID))
+	journalAssetChanges("Update", strAssetID, changes, buffer)
+	postAssetTimeline(strAssetID, espXmlmc, buffer)
+	mutexCounters.Lock()
+	counters.retired++
+	mutexCounters.Unlock()
+}
+
+// missingAssetsConfigured -- returns true if any asset type has a MissingAssets policy
+func missingAssetsConfigured() bool {
+	for _, v := range SQLImportConf.AssetTypes {
+		if v.MissingAssets.Action != "" {
+			return true
+		}
+	}
+	return false
+}
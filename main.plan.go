@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+	"github.com/jmoiron/sqlx"
+)
+
+//-- Plan mode
+//-- When -plan is set, the Hornbill caches and source records are loaded and compared as normal, but instead of any
+//-- changes being made, the changes that would be made are written to a human-readable and a JSON plan file
+
+type planStruct struct {
+	Created     string
+	ConfigFile  string
+	InstanceID  string
+	MappingHash string
+	Assets      []planAssetStruct
+}
+
+type planAssetStruct struct {
+	AssetType           string
+	Action              string
+	SourceID            string                   `json:",omitempty"`
+	AssetID             string                   `json:",omitempty"`
+	MatchRule           string                   `json:",omitempty"`
+	FromAssetType       string                   `json:",omitempty"`
+	Changes             []assetFieldChangeStruct `json:",omitempty"`
+	SoftwareAdd         []planSoftwareStruct     `json:",omitempty"`
+	SoftwareRemove      []planSoftwareStruct     `json:",omitempty"`
+	SoftwareRestore     []planSoftwareStruct     `json:",omitempty"`
+	SoftwareFingerprint string                   `json:",omitempty"`
+	Contract            string                   `json:",omitempty"`
+	Supplier            string                   `json:",omitempty"`
+	SourceRecord        map[string]interface{}   `json:",omitempty"`
+}
+
+type planSoftwareStruct struct {
+	AppID        string
+	Name         string                 `json:",omitempty"`
+	RecordID     int                    `json:",omitempty"`
+	SourceRecord map[string]interface{} `json:",omitempty"`
+}
+
+var runPlan planStruct
+
+// addPlanAsset -- adds the planned changes for an asset to the run plan, and to the asset's log entry
+func addPlanAsset(entry planAssetStruct, buffer *bytes.Buffer) {
+	buffer.WriteString(loggerGen(1, "[PLAN] "+strings.TrimRight(formatPlanAsset(entry), "\n")))
+	mutexPlan.Lock()
+	runPlan.Assets = append(runPlan.Assets, entry)
+	mutexPlan.Unlock()
+}
+
+// operationAllowed -- returns true if the OperationType of the asset type allows the create or update operation
+func operationAllowed(assetType assetTypesStruct, operation string) bool {
+	operationType := strings.ToLower(assetType.OperationType)
+	return operationType == "" || operationType == "both" || operationType == operation
+}
+
+// planAssetChanges -- works out the changes that processing a source record would make, and adds them to the run plan
+func planAssetChanges(entry planAssetStruct, assetType assetTypesStruct, u map[string]interface{}, hbRecord map[string]interface{}, boolUpdate, boolUpdateSI bool, softwareRecords map[string]map[string]interface{}, softwareRecordsHash string, espXmlmc *apiLib.XmlmcInstStruct, db *sqlx.DB, buffer *bytes.Buffer) {
+	if hbRecord == nil {
+		if !operationAllowed(assetType, "create") {
+			return
+		}
+		entry.Action = "Create"
+		primaryFields, extendedFields := getAssetFields(assetType, u, nil, "", "create", buffer)
+		entry.Changes = append(getFieldChanges("Asset", primaryFields, nil), getFieldChanges(getClassEntity(assetType.Class), extendedFields, nil)...)
+		entry.SourceRecord = getPlanRecord(u)
+		if assetType.Class == "computer" || assetType.Class == "mobileDevice" {
+			softwareRecords, softwareRecordsHash, _ = getSoftwareRecords(u, assetType, espXmlmc, db, buffer)
+			entry.SoftwareAdd, _ = getSoftwareChanges(softwareRecords, nil)
+			entry.SoftwareFingerprint = softwareRecordsHash
+		}
+		addPlanAsset(entry, buffer)
+		return
+	}
+
+	if !operationAllowed(assetType, "update") {
+		return
+	}
+	entry.Action = "Update"
+	if entry.FromAssetType != "" {
+		entry.Action = "Reclassify"
+	}
+	if boolUpdate {
+		primaryFields, extendedFields := getAssetFields(assetType, u, hbRecord, entry.AssetID, "update", buffer)
+		entry.Changes = append(getFieldChanges("Asset", primaryFields, hbRecord), getFieldChanges(getClassEntity(assetType.Class), extendedFields, hbRecord)...)
+	}
+	if boolUpdateSI {
+		hbSoftware, err := getHornbillSoftware(entry.AssetID, espXmlmc, buffer)
+		if err != nil {
+			buffer.WriteString(loggerGen(4, err.Error()))
+		} else {
+			entry.SoftwareAdd, entry.SoftwareRemove = getSoftwareChanges(softwareRecords, hbSoftware)
+			entry.SoftwareFingerprint = softwareRecordsHash
+			hornbillCount := len(hbSoftware)
+			if softRemovalEnabled(assetType) && len(hbSoftware) > 0 {
+				removedSoftware, err := getRemovedSoftware(entry.AssetID, assetType, espXmlmc, buffer)
+				if err != nil {
+					buffer.WriteString(loggerGen(4, "Unable to cache removed software inventory records: "+err.Error()))
+					entry.SoftwareAdd, entry.SoftwareRemove, entry.SoftwareFingerprint = nil, nil, ""
+				} else {
+					entry.SoftwareRemove, entry.SoftwareRestore = getSoftwareRemovalChanges(softwareRecords, hbSoftware, entry.SoftwareRemove, removedSoftware, assetType)
+					hornbillCount -= len(removedSoftware)
+				}
+			}
+			if reason := getSoftwareSafeguard(len(softwareRecords), hornbillCount, assetType); reason != "" {
+				buffer.WriteString(loggerGen(5, "[PLAN] Software inventory removals skipped for asset "+entry.AssetID+": "+reason))
+				entry.SoftwareRemove, entry.SoftwareFingerprint = nil, ""
+			}
+		}
+	}
+	if entry.FromAssetType == "" && !hasDataChanges(entry.Changes, assetType) && len(entry.SoftwareAdd) == 0 && len(entry.SoftwareRemove) == 0 && len(entry.SoftwareRestore) == 0 {
+		return
+	}
+	entry.SourceRecord = getPlanRecord(u)
+	addPlanAsset(entry, buffer)
+}
+
+// getHornbillSoftware -- reads the software inventory records of a Hornbill asset
+func getHornbillSoftware(assetID string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (map[string]softwareRecordDetailsStruct, error) {
+	hbSIRecordCount, err := getAssetSoftwareCount(assetID, espXmlmc, buffer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to count asset software inventory records: %v", err)
+	}
+	hbSICache, err := getAssetSoftwareRecords(assetID, hbSIRecordCount, espXmlmc, buffer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to cache asset software inventory records: %v", err)
+	}
+	return hbSICache, nil
+}
+
+// getSoftwareChanges -- compares the source software inventory against the Hornbill software inventory of an asset
+func getSoftwareChanges(softwareRecords map[string]map[string]interface{}, hbSoftware map[string]softwareRecordDetailsStruct) (softwareAdd, softwareRemove []planSoftwareStruct) {
+	for appID, record := range softwareRecords {
+		if _, ok := hbSoftware[appID]; !ok {
+			softwareAdd = append(softwareAdd, planSoftwareStruct{AppID: appID, SourceRecord: getPlanRecord(record)})
+		}
+	}
+	for appID, record := range hbSoftware {
+		if _, ok := softwareRecords[appID]; !ok {
+			softwareRemove = append(softwareRemove, planSoftwareStruct{AppID: appID, Name: record.HAppName, RecordID: record.HPKID})
+		}
+	}
+	sort.Slice(softwareAdd, func(i, j int) bool { return softwareAdd[i].AppID < softwareAdd[j].AppID })
+	sort.Slice(softwareRemove, func(i, j int) bool { return softwareRemove[i].AppID < softwareRemove[j].AppID })
+	return
+}
+
+// planMissingAsset -- adds the MissingAssets policy changes for a Hornbill asset to the run plan
+func planMissingAsset(hbRecord map[string]interface{}, assetType assetTypesStruct, buffer *bytes.Buffer) {
+	changes := getFieldChanges("Asset", getMissingAssetFields(assetType.MissingAssets, hbRecord), hbRecord)
+	if len(changes) == 0 {
+		return
+	}
+	addPlanAsset(planAssetStruct{
+		AssetType: assetType.AssetType,
+		Action:    strings.ToUpper(assetType.MissingAssets.Action[:1]) + strings.ToLower(assetType.MissingAssets.Action[1:]),
+		AssetID:   iToS(hbRecord["h_pk_asset_id"]),
+		SourceID:  iToS(hbRecord["h_name"]),
+		Changes:   changes,
+	}, buffer)
+}
+
+// getPlanRecord -- returns a copy of a source record that can be stored in a JSON plan
+func getPlanRecord(u map[string]interface{}) map[string]interface{} {
+	record := make(map[string]interface{})
+	for k, v := range u {
+		switch t := v.(type) {
+		case nil, string, bool, int64, int, float64:
+			record[k] = t
+		case time.Time:
+			record[k] = t.Format(hornbillDateFormat)
+		default:
+			record[k] = iToS(v)
+		}
+	}
+	return record
+}
+
+// formatPlanAsset -- returns the human-readable description of the planned changes for an asset
+func formatPlanAsset(entry planAssetStruct) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToUpper(entry.Action) + " [" + entry.AssetType + "] " + entry.SourceID)
+	var details []string
+	if entry.AssetID != "" {
+		details = append(details, "asset "+entry.AssetID)
+	}
+	if entry.MatchRule != "" {
+		details = append(details, "matched by "+entry.MatchRule)
+	}
+	if entry.FromAssetType != "" {
+		details = append(details, "from "+entry.FromAssetType)
+	}
+	if len(details) > 0 {
+		sb.WriteString(" (" + strings.Join(details, ", ") + ")")
+	}
+	sb.WriteString("\n")
+	for _, change := range entry.Changes {
+		newValue := strconv.Quote(change.NewValue)
+		if change.Clear {
+			newValue = "(cleared)"
+		}
+		if entry.Action == "Create" {
+			sb.WriteString("    " + change.Entity + "." + change.Field + ": " + newValue + "\n")
+		} else {
+			sb.WriteString("    " + change.Entity + "." + change.Field + ": " + strconv.Quote(change.OldValue) + " -> " + newValue + "\n")
+		}
+	}
+	if len(entry.SoftwareAdd) > 0 || len(entry.SoftwareRemove) > 0 || len(entry.SoftwareRestore) > 0 {
+		sb.WriteString("    Software: " + strconv.Itoa(len(entry.SoftwareAdd)) + " to add, " + strconv.Itoa(len(entry.SoftwareRemove)) + " to remove")
+		if len(entry.SoftwareRestore) > 0 {
+			sb.WriteString(", " + strconv.Itoa(len(entry.SoftwareRestore)) + " to restore")
+		}
+		sb.WriteString("\n")
+		for _, software := range entry.SoftwareAdd {
+			sb.WriteString("        + " + software.AppID + "\n")
+		}
+		for _, software := range entry.SoftwareRestore {
+			sb.WriteString("        ~ " + software.AppID + "\n")
+		}
+		for _, software := range entry.SoftwareRemove {
+			sb.WriteString("        - " + software.AppID + "\n")
+		}
+	}
+	if entry.Contract != "" {
+		sb.WriteString("    Contract link: " + entry.Contract + "\n")
+	}
+	if entry.Supplier != "" {
+		sb.WriteString("    Supplier link: " + entry.Supplier + "\n")
+	}
+	return sb.String()
+}
+
+// writePlan -- writes the run plan to human-readable and JSON files in the log folder, and outputs a summary
+func writePlan() {
+	sort.SliceStable(runPlan.Assets, func(i, j int) bool {
+		a, b := runPlan.Assets[i], runPlan.Assets[j]
+		if a.AssetType != b.AssetType {
+			return a.AssetType < b.AssetType
+		}
+		if a.Action != b.Action {
+			return a.Action < b.Action
+		}
+		return a.SourceID+a.AssetID < b.SourceID+b.AssetID
+	})
+	runPlan.Created = startTime.Format(hornbillDateFormat)
+	runPlan.ConfigFile = configFileName
+	runPlan.InstanceID = SQLImportConf.InstanceID
+	runPlan.MappingHash = mappingHash
+
+	actionCounts := make(map[string]int)
+	var text strings.Builder
+	text.WriteString("Asset Import Plan - " + runPlan.Created + " - " + runPlan.ConfigFile + "\n\n")
+	for _, entry := range runPlan.Assets {
+		actionCounts[entry.Action]++
+		text.WriteString(formatPlanAsset(entry) + "\n")
+	}
+
+	cwd, _ := os.Getwd()
+	planFileName := cwd + "/log/Asset_Plan_" + startTime.Format("20060102150405")
+	planJSON, err := json.MarshalIndent(runPlan, "", "  ")
+	if err != nil {
+		logger(4, "[PLAN] Unable to encode plan: "+err.Error(), true, true)
+		return
+	}
+	if err = os.WriteFile(planFileName+".json", planJSON, 0644); err != nil {
+		logger(4, "[PLAN] Unable to write plan: "+err.Error(), true, true)
+		return
+	}
+	if err = os.WriteFile(planFileName+".txt", []byte(text.String()), 0644); err != nil {
+		logger(4, "[PLAN] Unable to write plan: "+err.Error(), true, true)
+		return
+	}
+
+	var actions []string
+	for action := range actionCounts {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		logger(1, "[PLAN] "+action+": "+strconv.Itoa(actionCounts[action]), true, true)
+	}
+	logger(1, "[PLAN] "+strconv.Itoa(len(runPlan.Assets))+" asset changes planned, no changes have been made", true, true)
+	logger(1, "[PLAN] Plan written to "+planFileName+".txt and "+planFileName+".json", true, false)
+}
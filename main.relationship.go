@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- Asset relationships
+//-- Once every asset type has been processed, the Relationships query of each asset type is run against the source
+//-- database. The parent and child identifiers it returns are resolved to Hornbill assets through the assets map,
+//-- and any relationship that does not already exist is created in Configuration Manager
+
+const relationshipEntity = "ConfigurationItemsDependencies"
+
+type xmlmcRelationshipsResponse struct {
+	MethodResult string                  `xml:"status,attr"`
+	Rows         []relationshipRowStruct `xml:"params>rowData>row"`
+	State        stateStruct             `xml:"state"`
+}
+
+type relationshipRowStruct struct {
+	ChildID string `xml:"h_dependency_id"`
+	Type    string `xml:"h_dependency_type"`
+}
+
+// checkRelationshipsConf -- validates the Relationships configuration of each asset type
+func checkRelationshipsConf() error {
+	for _, v := range SQLImportConf.AssetTypes {
+		rel := v.Relationships
+		if rel.Query == "" {
+			continue
+		}
+		if rel.ParentColumn == "" || rel.ChildColumn == "" {
+			return errors.New("Relationships for asset type " + v.AssetType + " must have a ParentColumn and ChildColumn")
+		}
+		if rel.TypeColumn == "" && rel.Type == "" {
+			return errors.New("Relationships for asset type " + v.AssetType + " must have a TypeColumn or Type")
+		}
+	}
+	return nil
+}
+
+// processRelationships -- imports the relationships of every asset type that has a Relationships query
+func processRelationships() {
+	if configRehashOnly {
+		return
+	}
+	var relTypes []assetTypesStruct
+	for _, v := range SQLImportConf.AssetTypes {
+		if v.Relationships.Query != "" {
+			relTypes = append(relTypes, v)
+		}
+	}
+	if len(relTypes) == 0 {
+		return
+	}
+	if !configManagerInstalled() {
+		logger(5, "[RELATIONSHIP] Configuration Manager is not installed, asset relationships will not be imported", true, true)
+		return
+	}
+
+	espXmlmc := apiLib.NewXmlmcInstance(SQLImportConf.InstanceID)
+	espXmlmc.SetAPIKey(SQLImportConf.APIKey)
+	existingLinks := make(map[string]map[string]bool)
+	for _, v := range relTypes {
+		rows, err := queryRelationships(v)
+		if err != nil {
+			logger(4, "[RELATIONSHIP] "+err.Error(), true, true)
+			continue
+		}
+		logger(3, "[RELATIONSHIP] Processing "+strconv.Itoa(len(rows))+" "+v.AssetType+" relationships...", true, true)
+		for _, row := range rows {
+			var buffer bytes.Buffer
+			processRelationship(row, v.Relationships, existingLinks, espXmlmc, &buffer)
+			loggerWriteBuffer(buffer.String())
+		}
+	}
+}
+
+// queryRelationships -- runs the Relationships query of an asset type against the source database
+func queryRelationships(assetType assetTypesStruct) ([]map[string]interface{}, error) {
+	db, err := makeDBConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	logger(3, "[DATABASE] Query for "+assetType.AssetType+" relationships:"+assetType.Relationships.Query, false, true)
+	rows, err := db.Queryx(assetType.Relationships.Query)
+	if err != nil {
+		return nil, errors.New("[DATABASE] Database Query Error: " + fmt.Sprintf("%v", err))
+	}
+	defer rows.Close()
+	var relRows []map[string]interface{}
+	for rows.Next() {
+		results := make(map[string]interface{})
+		if err = rows.MapScan(results); err != nil {
+			return nil, errors.New("[DATABASE] Data Unmarshal Error: " + fmt.Sprintf("%v", err))
+		}
+		relRows = append(relRows, results)
+	}
+	return relRows, nil
+}
+
+// processRelationship -- resolves the parent and child of a relationship record, and creates the link if it does not exist
+func processRelationship(row map[string]interface{}, rel relationshipsStruct, existingLinks map[string]map[string]bool, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	parentID := strings.TrimSpace(iToS(row[rel.ParentColumn]))
+	childID := strings.TrimSpace(iToS(row[rel.ChildColumn]))
+	relType := rel.Type
+	if rel.TypeColumn != "" && iToS(row[rel.TypeColumn]) != "" {
+		relType = strings.TrimSpace(iToS(row[rel.TypeColumn]))
+	}
+	description := "[" + parentID + "] " + relType + " [" + childID + "]"
+
+	mutexAssets.Lock()
+	parentPK, parentFound := assets[parentID]
+	childPK, childFound := assets[childID]
+	mutexAssets.Unlock()
+	if parentID == "" || childID == "" || !parentFound || !childFound || parentPK == "" || childPK == "" {
+		buffer.WriteString(loggerGen(5, "[RELATIONSHIP] Unable to resolve the parent and child assets of relationship "+description))
+		mutexCounters.Lock()
+		counters.linksUnresolved++
+		mutexCounters.Unlock()
+		return
+	}
+
+	links, ok := existingLinks[parentPK]
+	if !ok {
+		var err error
+		links, err = getAssetRelationships(parentPK, espXmlmc, buffer)
+		if err != nil {
+			buffer.WriteString(loggerGen(4, "[RELATIONSHIP] Unable to read the relationships of asset "+parentPK+": "+err.Error()))
+			mutexCounters.Lock()
+			counters.linksFailed++
+			mutexCounters.Unlock()
+			return
+		}
+		existingLinks[parentPK] = links
+	}
+	linkKey := childPK + "|" + strings.ToLower(relType)
+	if links[linkKey] {
+		debugLog(buffer, "Relationship already exists:", description)
+		mutexCounters.Lock()
+		counters.linksSkipped++
+		mutexCounters.Unlock()
+		return
+	}
+
+	espXmlmc.SetParam("application", "com.hornbill.configurationmanager")
+	espXmlmc.SetParam("entity", relationshipEntity)
+	espXmlmc.SetParam("returnModifiedData", "false")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_entity_id", parentPK)
+	espXmlmc.SetParam("h_entity_name", "asset")
+	espXmlmc.SetParam("h_dependency_id", childPK)
+	espXmlmc.SetParam("h_dependency_entity_name", "asset")
+	espXmlmc.SetParam("h_dependency_type", relType)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	if err := invokeEntityChange(espXmlmc, "entityAddRecord", "Asset Relationship", buffer); err != nil {
+		buffer.WriteString(loggerGen(4, "[RELATIONSHIP] Unable to create relationship "+description+": "+err.Error()))
+		mutexCounters.Lock()
+		counters.linksFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	links[linkKey] = true
+	if configDryRun {
+		mutexCounters.Lock()
+		counters.linksSkipped++
+		mutexCounters.Unlock()
+		return
+	}
+	buffer.WriteString(loggerGen(1, "[RELATIONSHIP] Relationship created: "+description))
+	mutexCounters.Lock()
+	counters.linksCreated++
+	mutexCounters.Unlock()
+}
+
+// getAssetRelationships -- returns the existing relationships of a parent asset, keyed on child asset and relationship type
+// Relationships are read in pages, so that no existing link is missed on assets with many children
+func getAssetRelationships(parentPK string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (map[string]bool, error) {
+	links := make(map[string]bool)
+	for rowStart := 0; ; rowStart += browsePageSize {
+		espXmlmc.SetParam("application", "com.hornbill.configurationmanager")
+		espXmlmc.SetParam("entity", relationshipEntity)
+		espXmlmc.OpenElement("searchFilter")
+		espXmlmc.SetParam("column", "h_entity_id")
+		espXmlmc.SetParam("value", parentPK)
+		espXmlmc.SetParam("matchType", "exact")
+		espXmlmc.CloseElement("searchFilter")
+		espXmlmc.OpenElement("searchFilter")
+		espXmlmc.SetParam("column", "h_entity_name")
+		espXmlmc.SetParam("value", "asset")
+		espXmlmc.SetParam("matchType", "exact")
+		espXmlmc.CloseElement("searchFilter")
+		espXmlmc.SetParam("maxResults", strconv.Itoa(browsePageSize))
+		espXmlmc.SetParam("rowStart", strconv.Itoa(rowStart))
+		XMLSTRING := espXmlmc.GetParam()
+		debugLog(buffer, "Asset Relationships XML:", XMLSTRING)
+		XMLBrowse, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+		if xmlmcErr != nil {
+			return nil, errors.New("API Call failed: " + xmlmcErr.Error())
+		}
+		var xmlRespon xmlmcRelationshipsResponse
+		err := xml.Unmarshal([]byte(XMLBrowse), &xmlRespon)
+		if err != nil {
+			return nil, errors.New("Unable to read response from Hornbill instance: " + err.Error())
+		}
+		if xmlRespon.MethodResult != "ok" {
+			return nil, errors.New(xmlRespon.State.ErrorRet)
+		}
+		for _, row := range xmlRespon.Rows {
+			links[row.ChildID+"|"+strings.ToLower(row.Type)] = true
+		}
+
+		//-- A short page is the last page
+		if len(xmlRespon.Rows) < browsePageSize {
+			break
+		}
+	}
+	return links, nil
+}
+
+// relationshipsConfigured -- returns true if any asset type has a Relationships query
+func relationshipsConfigured() bool {
+	for _, v := range SQLImportConf.AssetTypes {
+		if v.Relationships.Query != "" {
+			return true
+		}
+	}
+	return false
+}
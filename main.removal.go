@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- Software soft-removal
+//-- When the SoftwareInventory Removal Mode of an asset type is Soft, software inventory records for applications that
+//-- are no longer returned by the source are marked as removed instead of being deleted, so the install history is kept.
+//-- Records are restored if the application reappears, and are only deleted once they have been removed for RetentionDays
+
+type removedSoftwareStruct struct {
+	PKID        int
+	RemovedDate string
+	State       string
+}
+
+type xmlmcSoftwareBrowseResponse struct {
+	MethodResult string        `xml:"status,attr"`
+	Rows         []updatedCols `xml:"params>rowData>row"`
+	State        stateStruct   `xml:"state"`
+}
+
+// checkSoftwareRemovalConf -- validates the software inventory Removal and Safeguard configuration of each asset type
+func checkSoftwareRemovalConf() error {
+	for _, v := range SQLImportConf.AssetTypes {
+		removal := v.SoftwareInventory.Removal
+		switch strings.ToLower(removal.Mode) {
+		case "", "delete":
+		case "soft":
+			if removal.DateColumn == "" {
+				return errors.New("SoftwareInventory Removal for asset type " + v.AssetType + " must have a DateColumn when Mode is Soft")
+			}
+			if removal.RetentionDays < 0 {
+				return errors.New("SoftwareInventory Removal RetentionDays for asset type " + v.AssetType + " cannot be negative")
+			}
+		default:
+			return errors.New("SoftwareInventory Removal Mode for asset type " + v.AssetType + " must be Delete or Soft")
+		}
+		if v.SoftwareInventory.Safeguard.MaxDropPercent < 0 || v.SoftwareInventory.Safeguard.MaxDropPercent > 100 {
+			return errors.New("SoftwareInventory Safeguard MaxDropPercent for asset type " + v.AssetType + " must be between 0 and 100")
+		}
+	}
+	return nil
+}
+
+// softRemovalEnabled -- returns true if missing software inventory records of an asset type are marked as removed, rather than deleted
+func softRemovalEnabled(assetType assetTypesStruct) bool {
+	return strings.EqualFold(assetType.SoftwareInventory.Removal.Mode, "soft")
+}
+
+// softRemovalConfigured -- returns true if any asset type uses software soft-removal
+func softRemovalConfigured() bool {
+	for _, v := range SQLImportConf.AssetTypes {
+		if softRemovalEnabled(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// getSoftwareSafeguard -- returns the reason the software removals of an asset should be skipped, or an empty string if
+// they can go ahead. Removals are skipped when the number of records returned by the source has dropped by more than
+// MaxDropPercent against the records the asset holds in Hornbill
+func getSoftwareSafeguard(sourceCount, hornbillCount int, assetType assetTypesStruct) string {
+	safeguard := assetType.SoftwareInventory.Safeguard
+	if hornbillCount == 0 {
+		return ""
+	}
+	if safeguard.MaxDropPercent > 0 && sourceCount < hornbillCount && (hornbillCount-sourceCount)*100 > safeguard.MaxDropPercent*hornbillCount {
+		return "the source returned " + strconv.Itoa(sourceCount) + " software records, against " + strconv.Itoa(hornbillCount) + " in Hornbill, a drop of more than " + strconv.Itoa(safeguard.MaxDropPercent) + "%"
+	}
+	return ""
+}
+
+// softwareSafeguardConfigured -- returns true if any asset type has a software inventory Safeguard
+func softwareSafeguardConfigured() bool {
+	for _, v := range SQLImportConf.AssetTypes {
+		if v.SoftwareInventory.Safeguard.MaxDropPercent > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getRemovedSoftware -- returns the software inventory records of an asset that have been marked as removed, keyed on application ID
+// Records are read in pages, so that no removed record is missed on assets with large software inventories
+func getRemovedSoftware(assetID string, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (map[string]removedSoftwareStruct, error) {
+	removal := assetType.SoftwareInventory.Removal
+	removedSoftware := make(map[string]removedSoftwareStruct)
+	for rowStart := 0; ; rowStart += browsePageSize {
+		espXmlmc.SetParam("application", appServiceManager)
+		espXmlmc.SetParam("entity", "AssetsInstalledSoftware")
+		espXmlmc.OpenElement("searchFilter")
+		espXmlmc.SetParam("column", "h_fk_asset_id")
+		espXmlmc.SetParam("value", assetID)
+		espXmlmc.SetParam("matchType", "exact")
+		espXmlmc.CloseElement("searchFilter")
+		espXmlmc.SetParam("maxResults", strconv.Itoa(browsePageSize))
+		espXmlmc.SetParam("rowStart", strconv.Itoa(rowStart))
+		XMLSTRING := espXmlmc.GetParam()
+		debugLog(buffer, "Removed Software Get XML:", XMLSTRING)
+		XMLBrowse, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+		if xmlmcErr != nil {
+			return nil, errors.New("API Call failed when reading removed software inventory records:" + xmlmcErr.Error())
+		}
+		var xmlRespon xmlmcSoftwareBrowseResponse
+		err := xml.Unmarshal([]byte(XMLBrowse), &xmlRespon)
+		if err != nil {
+			return nil, errors.New("Unable to read response from Hornbill instance when reading removed software inventory records:" + err.Error())
+		}
+		if xmlRespon.MethodResult != "ok" {
+			return nil, errors.New("Unable to read removed software inventory records: " + xmlRespon.State.ErrorRet)
+		}
+
+		for _, row := range xmlRespon.Rows {
+			var appID string
+			var removed removedSoftwareStruct
+			for _, col := range row.ColList {
+				switch col.XMLName.Local {
+				case "h_pk_id":
+					removed.PKID, _ = strconv.Atoi(col.Amount)
+				case "h_app_id":
+					appID = col.Amount
+				case removal.DateColumn:
+					removed.RemovedDate = col.Amount
+				case removal.StateColumn:
+					removed.State = col.Amount
+				}
+			}
+			if appID != "" && removed.RemovedDate != "" {
+				removedSoftware[appID] = removed
+			}
+		}
+
+		//-- A short page is the last page
+		if len(xmlRespon.Rows) < browsePageSize {
+			break
+		}
+	}
+	debugLog(buffer, strconv.Itoa(len(removedSoftware)), "removed software records cached from Hornbill for Asset ID", assetID)
+	return removedSoftware, nil
+}
+
+// removeAssetSoftware -- removes a software inventory record that is no longer returned by the source, either by
+// deleting it or by marking it as removed, depending on the Removal Mode of the asset type
+func removeAssetSoftware(assetID string, record softwareRecordDetailsStruct, removedSoftware map[string]removedSoftwareStruct, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	if !softRemovalEnabled(assetType) {
+		return deleteSoftwareInventoryRecord(record.HPKID, espXmlmc, buffer)
+	}
+	removed, isRemoved := removedSoftware[record.HAppID]
+	return removeSoftwareRecord(assetID, record, removed, isRemoved, assetType, espXmlmc, buffer)
+}
+
+// removeSoftwareRecord -- marks a software inventory record as removed. Records that are already marked as removed are
+// deleted once they have been removed for longer than the retention period
+func removeSoftwareRecord(assetID string, record softwareRecordDetailsStruct, removed removedSoftwareStruct, isRemoved bool, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	removal := assetType.SoftwareInventory.Removal
+	if isRemoved {
+		if !purgeDue(removed, assetType) {
+			return nil
+		}
+		buffer.WriteString(loggerGen(1, "Purging software inventory record ["+record.HAppID+"], removed "+removed.RemovedDate))
+		if err := deleteSoftwareInventoryRecord(record.HPKID, espXmlmc, buffer); err != nil {
+			return err
+		}
+		mutexCounters.Lock()
+		counters.softwarePurged++
+		mutexCounters.Unlock()
+		return nil
+	}
+
+	changes := []assetFieldChangeStruct{{Entity: "AssetsInstalledSoftware", Field: removal.DateColumn, NewValue: time.Now().UTC().Format(hornbillDateFormat)}}
+	if removal.StateColumn != "" && removal.RemovedState != "" {
+		changes = append(changes, assetFieldChangeStruct{Entity: "AssetsInstalledSoftware", Field: removal.StateColumn, OldValue: removal.InstalledState, NewValue: removal.RemovedState})
+	}
+	if err := updateSoftwareRecord(record.HPKID, changes, espXmlmc, buffer); err != nil {
+		return err
+	}
+	debugLog(buffer, "Software inventory record marked as removed: "+strconv.Itoa(record.HPKID)+" - "+record.HAppName)
+	writeJournal(journalEntryStruct{Action: "SoftwareRemove", AssetID: assetID, RecordID: record.HPKID, Changes: changes}, buffer)
+	mutexCounters.Lock()
+	counters.softwareSoftRemoved++
+	mutexCounters.Unlock()
+	return nil
+}
+
+// purgeDue -- returns true if a removed software inventory record has passed the retention period of its asset type
+func purgeDue(removed removedSoftwareStruct, assetType assetTypesStruct) bool {
+	retentionDays := assetType.SoftwareInventory.Removal.RetentionDays
+	if retentionDays == 0 {
+		return false
+	}
+	removedDate, err := time.Parse(hornbillDateFormat, removed.RemovedDate)
+	if err != nil {
+		return false
+	}
+	return time.Since(removedDate) >= time.Duration(retentionDays)*24*time.Hour
+}
+
+// purgeRemovedSoftware -- deletes the removed software inventory records of an asset that have passed the retention period
+// The software fingerprint of an asset does not change while its removed records age, so this is run for every matched
+// asset whose software inventory is not otherwise being synced
+func purgeRemovedSoftware(assetID string, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	if configDryRun || configRehashOnly || assetID == "" || !softRemovalEnabled(assetType) || assetType.SoftwareInventory.Removal.RetentionDays == 0 {
+		return
+	}
+	if assetType.Class != "computer" && assetType.Class != "mobileDevice" {
+		return
+	}
+	removedSoftware, err := getRemovedSoftware(assetID, assetType, espXmlmc, buffer)
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to cache removed software inventory records: "+err.Error()))
+		return
+	}
+	for appID, removed := range removedSoftware {
+		if !purgeDue(removed, assetType) {
+			continue
+		}
+		record := softwareRecordDetailsStruct{HPKID: removed.PKID, HAppID: appID}
+		if err := removeSoftwareRecord(assetID, record, removed, true, assetType, espXmlmc, buffer); err != nil {
+			buffer.WriteString(loggerGen(4, "Error purging software inventory record: "+err.Error()))
+			mutexCounters.Lock()
+			counters.softwareRemoveFailed++
+			mutexCounters.Unlock()
+		}
+	}
+}
+
+// getSoftwareRemovalChanges -- drops records that are already marked as removed, and not yet due to be purged, from the
+// planned software removals, and returns the removed records whose applications have reappeared in the source
+func getSoftwareRemovalChanges(softwareRecords map[string]map[string]interface{}, hbSoftware map[string]softwareRecordDetailsStruct, softwareRemove []planSoftwareStruct, removedSoftware map[string]removedSoftwareStruct, assetType assetTypesStruct) (planRemove, planRestore []planSoftwareStruct) {
+	for _, software := range softwareRemove {
+		if removed, ok := removedSoftware[software.AppID]; !ok || purgeDue(removed, assetType) {
+			planRemove = append(planRemove, software)
+		}
+	}
+	for appID, removed := range removedSoftware {
+		if _, ok := softwareRecords[appID]; ok {
+			planRestore = append(planRestore, planSoftwareStruct{AppID: appID, Name: hbSoftware[appID].HAppName, RecordID: removed.PKID})
+		}
+	}
+	sort.Slice(planRestore, func(i, j int) bool { return planRestore[i].AppID < planRestore[j].AppID })
+	return
+}
+
+// restoreSoftwareRecord -- clears the removal of a software inventory record whose application has reappeared in the source
+func restoreSoftwareRecord(assetID string, removed removedSoftwareStruct, assetType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	removal := assetType.SoftwareInventory.Removal
+	changes := []assetFieldChangeStruct{{Entity: "AssetsInstalledSoftware", Field: removal.DateColumn, OldValue: removed.RemovedDate, Clear: true}}
+	if removal.StateColumn != "" && removal.RemovedState != "" {
+		changes = append(changes, assetFieldChangeStruct{Entity: "AssetsInstalledSoftware", Field: removal.StateColumn, OldValue: removed.State, NewValue: removal.InstalledState, Clear: removal.InstalledState == ""})
+	}
+	if err := updateSoftwareRecord(removed.PKID, changes, espXmlmc, buffer); err != nil {
+		return err
+	}
+	debugLog(buffer, "Software inventory record restored: "+strconv.Itoa(removed.PKID))
+	writeJournal(journalEntryStruct{Action: "SoftwareRestore", AssetID: assetID, RecordID: removed.PKID, Changes: changes}, buffer)
+	mutexCounters.Lock()
+	counters.softwareRestored++
+	mutexCounters.Unlock()
+	return nil
+}
+
+// updateSoftwareRecord -- applies field changes to a software inventory record
+func updateSoftwareRecord(pkid int, changes []assetFieldChangeStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	var nilAttrib []apiLib.ParamAttribStruct
+	nilAttrib = append(nilAttrib, apiLib.ParamAttribStruct{Name: "nil", Value: "true"})
+
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "AssetsInstalledSoftware")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_id", strconv.Itoa(pkid))
+	for _, change := range changes {
+		if change.Clear {
+			espXmlmc.SetParamAttr(change.Field, "", nilAttrib)
+		} else {
+			espXmlmc.SetParam(change.Field, change.NewValue)
+		}
+	}
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	return invokeEntityChange(espXmlmc, "entityUpdateRecord", "Software Record Update", buffer)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// processRoutedAssetTypes -- Runs the asset query once, and routes each returned row to an asset type
+// using the value in the AssetTypeRouting column (optionally translated via a lookup table)
+func processRoutedAssetTypes() {
+	routing := SQLImportConf.AssetTypeRouting
+	boolSQLAssets, rows := runAssetQuery(routing.Query, "routed")
+	if !boolSQLAssets {
+		return
+	}
+
+	var (
+		routedTypes []string
+		routedRows  = make(map[string][]map[string]interface{})
+	)
+	for _, row := range rows {
+		typeName := strings.TrimSpace(iToS(row[routing.Column]))
+		if typeName != "" && routing.Lookup != "" {
+			var err error
+			typeName, err = exprLookup([]string{routing.Lookup, typeName})
+			if err != nil {
+				logger(4, "Unable to route record: "+err.Error(), false, true)
+				typeName = ""
+			}
+		}
+		if _, ok := routedRows[typeName]; !ok {
+			routedTypes = append(routedTypes, typeName)
+		}
+		routedRows[typeName] = append(routedRows[typeName], row)
+	}
+
+	var (
+		assetTypes   []preparedAssetTypeStruct
+		routedConfig = make(map[string]bool)
+	)
+	for _, typeName := range routedTypes {
+		v, ok := getRoutedAssetType(typeName)
+		if ok {
+			v = setAssetType(v)
+			ok = v.Class != "" && v.TypeID != 0
+		}
+		if !ok {
+			logUnroutedRows(typeName, routedRows[typeName])
+			continue
+		}
+
+		arrAssets := make(map[string]map[string]interface{})
+		for _, row := range routedRows[typeName] {
+			arrAssets[fmt.Sprintf("%s", row[v.AssetIdentifier.DBColumn])] = row
+		}
+		logger(3, "[ROUTING] "+strconv.Itoa(len(arrAssets))+" records routed to asset type "+v.AssetType, true, true)
+		routedConfig[strings.ToLower(v.AssetType)] = true
+		assetTypes = append(assetTypes, prepareAssetType(arrAssets, v))
+	}
+
+	//Configured asset types that no records were routed to are still checked against their thresholds
+	for _, v := range SQLImportConf.AssetTypes {
+		if v.AssetType != "*" && !routedConfig[strings.ToLower(v.AssetType)] {
+			assetTypes = append(assetTypes, preparedAssetTypeStruct{AssetType: v, ArrAssets: make(map[string]map[string]interface{})})
+		}
+	}
+	processAssetTypes(assetTypes)
+}
+
+// getRoutedAssetType -- Returns the AssetTypes configuration for a routed asset type name
+// An AssetTypes entry with an AssetType of * is used for routed types that are not configured explicitly
+func getRoutedAssetType(typeName string) (assetTypesStruct, bool) {
+	var (
+		defaultType    assetTypesStruct
+		hasDefaultType bool
+	)
+	if typeName == "" {
+		return defaultType, false
+	}
+	for _, v := range SQLImportConf.AssetTypes {
+		if strings.EqualFold(v.AssetType, typeName) {
+			return v, true
+		}
+		if v.AssetType == "*" {
+			defaultType = v
+			hasDefaultType = true
+		}
+	}
+	defaultType.AssetType = typeName
+	return defaultType, hasDefaultType
+}
+
+// logUnroutedRows -- Reports records that could not be routed to a configured Hornbill asset type
+func logUnroutedRows(typeName string, rows []map[string]interface{}) {
+	mutexCounters.Lock()
+	counters.unrouted += uint32(len(rows))
+	mutexCounters.Unlock()
+	logger(5, "[ROUTING] "+strconv.Itoa(len(rows))+" records could not be routed to an asset type, "+SQLImportConf.AssetTypeRouting.Column+" value ["+typeName+"]", true, true)
+	v, _ := getRoutedAssetType(typeName)
+	idColumn := v.AssetIdentifier.DBColumn
+	if idColumn == "" && len(SQLImportConf.AssetTypes) > 0 {
+		idColumn = SQLImportConf.AssetTypes[0].AssetIdentifier.DBColumn
+	}
+	for _, row := range rows {
+		logger(5, "[ROUTING] Unrouted record: "+iToS(row[idColumn]), false, false)
+	}
+}
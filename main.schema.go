@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var entitySchemas = make(map[string]map[string]entityColumnStruct)
+
+// getClassEntity -- returns the name of the entity that holds the extended record for an asset class
+func getClassEntity(assetClass string) string {
+	switch assetClass {
+	case "basic":
+		return "AssetsBasic"
+	case "computer":
+		return "AssetsComputer"
+	case "computerPeripheral":
+		return "AssetsComputerPeripheral"
+	case "mobileDevice":
+		return "AssetsMobileDevice"
+	case "networkDevice":
+		return "AssetsNetworkDevice"
+	case "printer":
+		return "AssetsPrinter"
+	case "software":
+		return "AssetsSoftware"
+	case "telecoms":
+		return "AssetsTelecoms"
+	}
+	return ""
+}
+
+// loadEntitySchema -- retrieves and caches the column definitions of a Service Manager entity
+func loadEntitySchema(entity string) (map[string]entityColumnStruct, error) {
+	if schema, ok := entitySchemas[entity]; ok {
+		return schema, nil
+	}
+	hornbillImport.SetParam("application", appServiceManager)
+	hornbillImport.SetParam("entity", entity)
+	RespBody, err := hornbillImport.Invoke("data", "entityGetMetaData")
+	if err != nil {
+		return nil, errors.New("Unable to retrieve " + entity + " entity schema: " + err.Error())
+	}
+	var JSONResp xmlmcEntityMetaDataResponse
+	err = json.Unmarshal([]byte(RespBody), &JSONResp)
+	if err != nil {
+		return nil, errors.New("Unable to read " + entity + " entity schema: " + err.Error())
+	}
+	if JSONResp.State.Error != "" {
+		return nil, errors.New("Unable to retrieve " + entity + " entity schema: " + JSONResp.State.Error)
+	}
+	schema := make(map[string]entityColumnStruct)
+	for _, col := range JSONResp.Params.Columns.Column {
+		schema[col.Name] = col
+	}
+	if len(schema) == 0 {
+		return nil, errors.New("No columns returned in " + entity + " entity schema")
+	}
+	entitySchemas[entity] = schema
+	logger(1, "Loaded "+entity+" entity schema: "+strconv.Itoa(len(schema))+" columns", false, true)
+	return schema, nil
+}
+
+// checkMappingSchema -- checks that every field in a mapping exists as a column in the entity
+func checkMappingSchema(entity string, mapping map[string]interface{}) error {
+	if !SQLImportConf.SchemaValidation.Enabled {
+		return nil
+	}
+	schema, err := loadEntitySchema(entity)
+	if err != nil {
+		return err
+	}
+	var unknownColumns []string
+	for k := range mapping {
+		if _, ok := schema[k]; !ok {
+			unknownColumns = append(unknownColumns, k)
+		}
+	}
+	if len(unknownColumns) > 0 {
+		sort.Strings(unknownColumns)
+		return errors.New("Mapped fields do not exist in the " + entity + " entity: " + strings.Join(unknownColumns, ", "))
+	}
+	return nil
+}
+
+// checkFieldValue -- checks a mapped value against the type and size of the entity column before it is sent
+// Over-length strings are truncated if SchemaValidation OverLength is set to Truncate, otherwise an error is returned
+func checkFieldValue(entity string, k string, value string, buffer *bytes.Buffer) (string, error) {
+	if !SQLImportConf.SchemaValidation.Enabled || value == "" || value == "__clear__" {
+		return value, nil
+	}
+	col, ok := entitySchemas[entity][k]
+	if !ok {
+		return value, nil
+	}
+	dataType := strings.ToLower(col.DataType)
+	switch {
+	case strings.Contains(dataType, "int"):
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return value, errors.New("value [" + value + "] for " + k + " is not a valid " + col.DataType)
+		}
+	case strings.Contains(dataType, "decimal") || strings.Contains(dataType, "float") || strings.Contains(dataType, "double") || strings.Contains(dataType, "numeric"):
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return value, errors.New("value [" + value + "] for " + k + " is not a valid " + col.DataType)
+		}
+	case strings.Contains(dataType, "date") || strings.Contains(dataType, "time"):
+		if _, err := time.Parse(hornbillDateFormat, value); err != nil {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return value, errors.New("value [" + value + "] for " + k + " is not a valid " + col.DataType)
+			}
+		}
+	default:
+		size, _ := strconv.Atoi(iToS(col.Size))
+		if size > 0 && len([]rune(value)) > size {
+			if !strings.EqualFold(SQLImportConf.SchemaValidation.OverLength, "truncate") {
+				return value, errors.New("value for " + k + " is " + strconv.Itoa(len([]rune(value))) + " characters, the maximum is " + strconv.Itoa(size))
+			}
+			buffer.WriteString(loggerGen(5, "Value for "+k+" truncated to "+strconv.Itoa(size)+" characters"))
+			value = string([]rune(value)[:size])
+		}
+	}
+	return value, nil
+}
+
+// checkRecordValues -- checks all of the mapped values for a record before any of them are sent to Hornbill,
+// so that a record that fails validation is not partially created or updated
+// Fields whose Mode does not allow them to be written for the operation are not checked
+func checkRecordValues(assetType assetTypesStruct, u map[string]interface{}, operation string) error {
+	if !SQLImportConf.SchemaValidation.Enabled {
+		return nil
+	}
+	var mappingBuffer bytes.Buffer
+	mappings := []struct {
+		entity  string
+		mapping map[string]interface{}
+	}{
+		{"Asset", SQLImportConf.AssetGenericFieldMapping},
+		{getClassEntity(assetType.Class), SQLImportConf.AssetTypeFieldMapping},
+	}
+	for _, m := range mappings {
+		for k, v := range m.mapping {
+			if k == "h_used_by" || k == "h_owned_by" || k == "h_last_logged_on_user" || !fieldModeAllowed(v, operation) {
+				continue
+			}
+			value := getFieldValue(k, getFieldMapping(k, v, u, &mappingBuffer), u, &mappingBuffer)
+			if _, err := checkFieldValue(m.entity, k, value, &mappingBuffer); err != nil {
+				return errors.New("Schema validation failed for " + m.entity + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+//-- Per-record transform scripts
+//-- Scripts are written in Starlark (a Python dialect), and the configured function is called with each source row
+//-- as a dict before any field mapping takes place. The function can change the dict in place, return a new dict,
+//-- or return "skip" to exclude the record from the import
+
+const scriptSkip = "skip"
+
+var scriptGlobals starlark.StringDict
+
+// loadScript -- loads and compiles the configured script file, and checks that the transform functions exist
+func loadScript() error {
+	if SQLImportConf.Script.File == "" {
+		return nil
+	}
+	thread := &starlark.Thread{Name: "load", Print: scriptPrint(nil)}
+	globals, err := starlark.ExecFile(thread, SQLImportConf.Script.File, nil, nil)
+	if err != nil {
+		return errors.New("Unable to load script " + SQLImportConf.Script.File + ": " + scriptErrorString(err))
+	}
+	scriptGlobals = globals
+
+	functions := []string{SQLImportConf.Script.Function}
+	for _, v := range SQLImportConf.AssetTypes {
+		functions = append(functions, v.ScriptFunction)
+	}
+	for _, fnName := range functions {
+		if fnName == "" {
+			continue
+		}
+		if _, ok := scriptGlobals[fnName].(starlark.Callable); !ok {
+			return errors.New("Script function " + fnName + " not found in " + SQLImportConf.Script.File)
+		}
+	}
+	return nil
+}
+
+// getScriptFunction -- returns the name of the script function to run against records of an asset type
+func getScriptFunction(assetType assetTypesStruct) string {
+	if scriptGlobals == nil {
+		return ""
+	}
+	if assetType.ScriptFunction != "" {
+		return assetType.ScriptFunction
+	}
+	return SQLImportConf.Script.Function
+}
+
+// runScript -- calls the script function with a source row, and returns the transformed row
+// skip is returned as true if the script asked for the record to be excluded from the import
+func runScript(fnName string, row map[string]interface{}, buffer *bytes.Buffer) (newRow map[string]interface{}, skip bool, err error) {
+	fn, ok := scriptGlobals[fnName].(starlark.Callable)
+	if !ok {
+		err = errors.New("script function " + fnName + " not found")
+		return
+	}
+	dict, err := rowToStarlark(row)
+	if err != nil {
+		return
+	}
+	thread := &starlark.Thread{Name: fnName, Print: scriptPrint(buffer)}
+	result, err := starlark.Call(thread, fn, starlark.Tuple{dict}, nil)
+	if err != nil {
+		err = errors.New("script function " + fnName + " failed: " + scriptErrorString(err))
+		return
+	}
+	switch r := result.(type) {
+	case starlark.NoneType:
+		newRow, err = rowFromStarlark(dict)
+	case *starlark.Dict:
+		newRow, err = rowFromStarlark(r)
+	case starlark.String:
+		if string(r) != scriptSkip {
+			err = errors.New("script function " + fnName + " returned unexpected value " + r.String())
+			return
+		}
+		skip = true
+	default:
+		err = errors.New("script function " + fnName + " returned unexpected " + result.Type())
+	}
+	return
+}
+
+func rowToStarlark(row map[string]interface{}) (*starlark.Dict, error) {
+	dict := starlark.NewDict(len(row))
+	for k, v := range row {
+		var value starlark.Value
+		switch t := v.(type) {
+		case nil:
+			value = starlark.None
+		case []uint8:
+			value = starlark.String(string(t))
+		case string:
+			value = starlark.String(t)
+		case bool:
+			value = starlark.Bool(t)
+		case int64:
+			value = starlark.MakeInt64(t)
+		case int:
+			value = starlark.MakeInt(t)
+		case float64:
+			value = starlark.Float(t)
+		case time.Time:
+			value = starlark.String(t.Format(hornbillDateFormat))
+		default:
+			value = starlark.String(iToS(v))
+		}
+		if err := dict.SetKey(starlark.String(k), value); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+func rowFromStarlark(dict *starlark.Dict) (map[string]interface{}, error) {
+	row := make(map[string]interface{})
+	for _, item := range dict.Items() {
+		k, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, errors.New("script returned a column name that is not a string: " + item[0].String())
+		}
+		switch v := item[1].(type) {
+		case starlark.NoneType:
+			row[k] = nil
+		case starlark.String:
+			row[k] = string(v)
+		case starlark.Bool:
+			row[k] = bool(v)
+		case starlark.Int:
+			if i, ok := v.Int64(); ok {
+				row[k] = i
+			} else {
+				row[k] = v.BigInt().String()
+			}
+		case starlark.Float:
+			row[k] = float64(v)
+		default:
+			row[k] = v.String()
+		}
+	}
+	return row, nil
+}
+
+func scriptPrint(buffer *bytes.Buffer) func(*starlark.Thread, string) {
+	return func(thread *starlark.Thread, msg string) {
+		if buffer == nil {
+			logger(1, "[SCRIPT] "+msg, false, false)
+		} else {
+			buffer.WriteString(loggerGen(1, "[SCRIPT] "+msg))
+		}
+	}
+}
+
+func scriptErrorString(err error) string {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return evalErr.Backtrace()
+	}
+	return err.Error()
+}
+
+// testScript -- runs the configured script function against each row in a JSON file of sample rows,
+// and outputs the transformed rows, so scripts can be tested without connecting to the source database or Hornbill
+func testScript(sampleFile string) bool {
+	err := loadScript()
+	if err != nil {
+		fmt.Println(err.Error())
+		return false
+	}
+	if scriptGlobals == nil {
+		fmt.Println("No Script File set in the configuration")
+		return false
+	}
+	sampleBytes, err := os.ReadFile(sampleFile)
+	if err != nil {
+		fmt.Println("Unable to read sample rows file: " + err.Error())
+		return false
+	}
+	var samples []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(sampleBytes))
+	decoder.UseNumber()
+	err = decoder.Decode(&samples)
+	if err != nil {
+		fmt.Println("Unable to decode sample rows file, it should contain an array of objects: " + err.Error())
+		return false
+	}
+
+	functions := []string{SQLImportConf.Script.Function}
+	for _, v := range SQLImportConf.AssetTypes {
+		if v.ScriptFunction != "" && v.ScriptFunction != SQLImportConf.Script.Function {
+			functions = append(functions, v.ScriptFunction)
+		}
+	}
+	boolPassed := true
+	for _, fnName := range functions {
+		if fnName == "" {
+			continue
+		}
+		for i, sample := range samples {
+			for k, v := range sample {
+				if n, ok := v.(json.Number); ok {
+					sample[k] = jsonNumberValue(n)
+				}
+			}
+			var buffer bytes.Buffer
+			newRow, skip, err := runScript(fnName, sample, &buffer)
+			fmt.Print(strings.ReplaceAll(buffer.String(), "\n\r", "\n"))
+			label := fnName + " - sample row " + fmt.Sprintf("%d", i+1) + ": "
+			switch {
+			case err != nil:
+				boolPassed = false
+				fmt.Println(label + "ERROR " + err.Error())
+			case skip:
+				fmt.Println(label + "skip")
+			default:
+				var keys []string
+				for k := range newRow {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				fmt.Println(label)
+				for _, k := range keys {
+					fmt.Println("    " + k + ": " + fmt.Sprintf("%#v", newRow[k]))
+				}
+			}
+		}
+	}
+	return boolPassed
+}
+
+func jsonNumberValue(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
@@ -109,7 +109,7 @@ func loadSites() {
 }
 
 func getSiteID(u map[string]interface{}, buffer *bytes.Buffer) (siteID int, siteName string) {
-	siteNameMapping := fmt.Sprintf("%v", SQLImportConf.AssetGenericFieldMapping["h_site"])
+	siteNameMapping := getFieldMapping("h_site", SQLImportConf.AssetGenericFieldMapping["h_site"], u, buffer)
 	siteName = getFieldValue("h_site", siteNameMapping, u, buffer)
 	if siteName != "" && siteName != "__clear__" {
 		mutexSite.Lock()
@@ -95,6 +95,7 @@ func addSoftwareInventoryRecord(fkAssetID string, softwareRecord map[string]inte
 	}
 	pkid = xmlRespon.Params.HPKID
 	debugLog(buffer, "Software inventory record successfully created: "+strconv.Itoa(pkid)+" - "+packageName)
+	writeJournal(journalEntryStruct{Action: "SoftwareAdd", AssetID: fkAssetID, RecordID: pkid}, buffer)
 	mutexCounters.Lock()
 	counters.softwareCreated++
 	mutexCounters.Unlock()
@@ -102,6 +103,14 @@ func addSoftwareInventoryRecord(fkAssetID string, softwareRecord map[string]inte
 }
 
 func deleteSoftwareInventoryRecord(pkid int, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (err error) {
+	//Journal the record before it is deleted, so that it can be restored by a rollback
+	var journalRecord map[string]string
+	if journalEnabled() {
+		journalRecord, err = getSoftwareInventoryRecord(pkid, espXmlmc, buffer)
+		if err != nil {
+			return
+		}
+	}
 	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
 	espXmlmc.SetParam("entity", "AssetsInstalledSoftware")
 	espXmlmc.SetParam("keyValue", strconv.Itoa(pkid))
@@ -128,6 +137,7 @@ func deleteSoftwareInventoryRecord(pkid int, espXmlmc *apiLib.XmlmcInstStruct, b
 		return
 	}
 	debugLog(buffer, "Software inventory record successfully deleted: "+strconv.Itoa(pkid))
+	writeJournal(journalEntryStruct{Action: "SoftwareDelete", AssetID: journalRecord["h_fk_asset_id"], RecordID: pkid, Record: journalRecord}, buffer)
 	mutexCounters.Lock()
 	counters.softwareRemoved++
 	mutexCounters.Unlock()
@@ -249,6 +259,26 @@ func updateAssetSI(assetID string, softwareRecords map[string]map[string]interfa
 			err = errors.New("Unable to cache asset software inventory records: " + err.Error())
 		}
 	}
+	removedSoftware := make(map[string]removedSoftwareStruct)
+	if len(hbSICache) > 0 && softRemovalEnabled(assetType) {
+		removedSoftware, err = getRemovedSoftware(assetID, assetType, espXmlmc, buffer)
+		if err != nil {
+			buffer.WriteString(loggerGen(4, "Unable to cache removed software inventory records: "+err.Error()))
+			err = errors.New("Unable to cache removed software inventory records: " + err.Error())
+			return
+		}
+	}
+	//Skip removals if the source looks to have returned partial software data for the asset.
+	//The software fingerprint is left unchanged, so the asset's software is processed again on the next run
+	skipRemovals := false
+	if reason := getSoftwareSafeguard(len(softwareRecords), len(hbSICache)-len(removedSoftware), assetType); reason != "" {
+		buffer.WriteString(loggerGen(5, "Software inventory removals skipped for asset "+assetID+": "+reason))
+		mutexCounters.Lock()
+		counters.softwareGuarded++
+		mutexCounters.Unlock()
+		skipRemovals = true
+		boolUpdateSoftwareHash = false
+	}
 	if len(hbSICache) > 0 {
 		//Loop through HB SI cache for this asset, see if match exists in softwareRecords. If not exists, delete
 		for cK, cV := range hbSICache {
@@ -259,8 +289,8 @@ func updateAssetSI(assetID string, softwareRecords map[string]map[string]interfa
 					delRec = false
 				}
 			}
-			if delRec {
-				err = deleteSoftwareInventoryRecord(cV.HPKID, espXmlmc, buffer)
+			if delRec && !skipRemovals {
+				err = removeAssetSoftware(assetID, cV, removedSoftware, assetType, espXmlmc, buffer)
 				if err != nil {
 					mutexCounters.Lock()
 					counters.softwareRemoveFailed++
@@ -280,6 +310,17 @@ func updateAssetSI(assetID string, softwareRecords map[string]map[string]interfa
 					addRec = false
 				}
 			}
+			if removed, ok := removedSoftware[sK]; ok && !addRec {
+				//Software has reappeared on the asset since it was marked as removed
+				err := restoreSoftwareRecord(assetID, removed, assetType, espXmlmc, buffer)
+				if err != nil {
+					buffer.WriteString(loggerGen(4, "Error restoring software record:"+err.Error()))
+					mutexCounters.Lock()
+					counters.softwareCreateFailed++
+					mutexCounters.Unlock()
+					boolUpdateSoftwareHash = false
+				}
+			}
 			if addRec {
 				_, err := addSoftwareInventoryRecord(assetID, sV, assetType, espXmlmc, buffer)
 				if err != nil {
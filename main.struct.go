@@ -13,6 +13,7 @@ const (
 	version           = "1.16.1"
 	appServiceManager = "com.hornbill.servicemanager"
 	appName           = "goDBAssetImport"
+	browsePageSize    = 1000
 )
 
 //----- Variables -----
@@ -29,6 +30,14 @@ var (
 	configDebug            bool
 	configDryRun           bool
 	configVersion          bool
+	configTestScript       string
+	configForce            string
+	configRehashOnly       bool
+	configIgnoreThresholds bool
+	configPlan             bool
+	configApply            string
+	configRollback         string
+	mappingHash            string
 	Customers              []customerListStruct
 	startTime              time.Time
 	AssetClass             string
@@ -43,8 +52,13 @@ var (
 	mutexBuffer            = &sync.Mutex{}
 	mutexCounters          = &sync.Mutex{}
 	mutexCustomers         = &sync.Mutex{}
+	mutexExprRegex         = &sync.Mutex{}
 	mutexGroup             = &sync.Mutex{}
+	mutexJournal           = &sync.Mutex{}
+	mutexMovedAssets       = &sync.Mutex{}
+	mutexPlan              = &sync.Mutex{}
 	mutexSite              = &sync.Mutex{}
+	mutexTimeline          = &sync.Mutex{}
 	worker                 sync.WaitGroup
 	maxGoroutines          = 1
 	logFilePart            = 0
@@ -78,6 +92,33 @@ type counterTypeStruct struct {
 	softwareSkipped      uint32
 	softwareCreateFailed uint32
 	softwareRemoveFailed uint32
+	softwareSoftRemoved  uint32
+	softwareRestored     uint32
+	softwarePurged       uint32
+	softwareGuarded      uint32
+	unrouted             uint32
+	scriptSkipped        uint32
+	scriptFailed         uint32
+	filtered             uint32
+	rehashed             uint32
+	rehashSkipped        uint32
+	rehashFailed         uint32
+	retired              uint32
+	retireSkipped        uint32
+	retireFailed         uint32
+	moved                uint32
+	moveFailed           uint32
+	duplicates           uint32
+	duplicateSkipped     uint32
+	applyRefused         uint32
+	rolledBack           uint32
+	rollbackFailed       uint32
+	linksCreated         uint32
+	linksSkipped         uint32
+	linksFailed          uint32
+	linksUnresolved      uint32
+	timelinePosted       uint32
+	timelineFailed       uint32
 }
 type sqlImportConfStruct struct {
 	APIKey                   string
@@ -89,6 +130,55 @@ type sqlImportConfStruct struct {
 	AssetTypes               []assetTypesStruct
 	AssetGenericFieldMapping map[string]interface{}
 	AssetTypeFieldMapping    map[string]interface{}
+	Lookups                  map[string]lookupTableStruct
+	DateConf                 dateConfStruct
+	AssetTypeRouting         assetTypeRoutingStruct
+	Script                   scriptConfStruct
+	SchemaValidation         schemaValidationStruct
+	DetectTypeChanges        bool
+	DuplicatePolicy          string
+	HashExcludeColumns       []string
+	Timeline                 timelineStruct
+}
+
+type timelineStruct struct {
+	Enabled          bool
+	Visibility       string
+	Template         string
+	FieldTemplate    string
+	SoftwareTemplate string
+}
+
+type schemaValidationStruct struct {
+	Enabled    bool
+	OverLength string
+}
+
+type scriptConfStruct struct {
+	File     string
+	Function string
+}
+
+type assetTypeRoutingStruct struct {
+	Column string
+	Lookup string
+	Query  string
+}
+
+type dateConfStruct struct {
+	InputFormats []string
+	Timezone     string
+	Fields       map[string]dateFormatStruct
+}
+
+type dateFormatStruct struct {
+	InputFormats []string
+	Timezone     string
+}
+
+type lookupTableStruct struct {
+	Values  map[string]string
+	Default *string
 }
 
 type assetTypesStruct struct {
@@ -99,12 +189,55 @@ type assetTypesStruct struct {
 	PreserveSubState         bool
 	PreserveOperationalState bool
 	Query                    string
+	ScriptFunction           string
+	Filters                  []filterStruct
+	MissingAssets            missingAssetsStruct
+	Thresholds               thresholdsStruct
 	AssetIdentifier          assetIdentifierStruct
 	SoftwareInventory        softwareInventoryStruct
+	Relationships            relationshipsStruct
 	Class                    string
 	TypeID                   int
 }
 
+type preparedAssetTypeStruct struct {
+	AssetType    assetTypesStruct
+	ArrAssets    map[string]map[string]interface{}
+	SourceAssets map[string]map[string]interface{}
+	AssetCache   map[string]map[string]interface{}
+	Ready        bool
+}
+
+type filterStruct struct {
+	Type     string
+	Column   string
+	Operator string
+	Value    string
+}
+
+type relationshipsStruct struct {
+	Query        string
+	ParentColumn string
+	ChildColumn  string
+	TypeColumn   string
+	Type         string
+}
+
+type missingAssetsStruct struct {
+	Action           string
+	RecordState      string
+	OperationalState string
+	SubStateID       string
+	SubStateName     string
+	SetRetiredDate   bool
+}
+
+type thresholdsStruct struct {
+	MaxRetiredPercent float64
+	MaxUpdatedPercent float64
+	MinSourceRows     int
+}
+
 type assetIdentifierStruct struct {
 	DBContractColumn string
 	DBSupplierColumn string
@@ -112,6 +245,17 @@ type assetIdentifierStruct struct {
 	DBColumn         string
 	Entity           string
 	EntityColumn     string
+	MatchRules       []matchRuleStruct
+}
+
+type matchRuleStruct struct {
+	Name string
+	Keys []matchKeyStruct
+}
+
+type matchKeyStruct struct {
+	DBColumn     string
+	EntityColumn string
 }
 
 type softwareInventoryStruct struct {
@@ -119,6 +263,37 @@ type softwareInventoryStruct struct {
 	AppIDColumn   string
 	Query         string
 	Mapping       map[string]interface{}
+	Removal       softwareRemovalStruct
+	Safeguard     softwareSafeguardStruct
+}
+
+type softwareSafeguardStruct struct {
+	MaxDropPercent int
+}
+
+type softwareRemovalStruct struct {
+	Mode           string
+	DateColumn     string
+	StateColumn    string
+	RemovedState   string
+	InstalledState string
+	RetentionDays  int
+}
+
+type assetFieldStruct struct {
+	Field string
+	Value string
+	Clear bool
+}
+
+type assetFieldChangeStruct struct {
+	Entity   string
+	Field    string
+	OldValue string
+	NewValue string
+	Clear    bool
+	//NotCached is set when the field was not returned in the Hornbill cache, so OldValue is not known
+	NotCached bool `json:",omitempty"`
 }
 
 type sqlConfStruct struct {
@@ -285,3 +460,19 @@ type paramsStruct struct {
 	SessionID string `xml:"sessionId"`
 	HPKID     int    `xml:"primaryEntityData>record>h_pk_id"`
 }
+
+//Entity Schema Structures
+type xmlmcEntityMetaDataResponse struct {
+	Params struct {
+		Columns struct {
+			Column []entityColumnStruct `json:"column"`
+		} `json:"columns"`
+	} `json:"params"`
+	State stateJSONStruct `json:"state"`
+}
+
+type entityColumnStruct struct {
+	Name     string      `json:"name"`
+	DataType string      `json:"dataType"`
+	Size     interface{} `json:"size"`
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// checkThresholds -- checks the mass-change thresholds of the asset type against the source records and Hornbill cache,
+// before anything is written, and returns a description of each threshold that would be breached
+// arrAssets is every record returned by the query, sourceAssets are the records left to process after filtering
+func checkThresholds(arrAssets, sourceAssets, assetsCache map[string]map[string]interface{}, assetType assetTypesStruct) (breaches []string) {
+	t := assetType.Thresholds
+	if t.MinSourceRows > 0 && len(arrAssets) < t.MinSourceRows {
+		breaches = append(breaches, fmt.Sprintf("The source query returned %d records, the minimum is %d", len(arrAssets), t.MinSourceRows))
+	}
+	if len(assetsCache) == 0 {
+		return
+	}
+	if t.MaxRetiredPercent > 0 && assetType.MissingAssets.Action != "" {
+		missingCount := len(getMissingAssets(arrAssets, assetsCache, assetType))
+		if percent := thresholdPercent(missingCount, len(assetsCache)); percent > t.MaxRetiredPercent {
+			breaches = append(breaches, fmt.Sprintf("%d of %d cached assets (%.1f%%) would be %sd, the maximum is %.1f%%", missingCount, len(assetsCache), percent, assetType.MissingAssets.Action, t.MaxRetiredPercent))
+		}
+	}
+	if t.MaxUpdatedPercent > 0 {
+		updateCount := countExpectedUpdates(sourceAssets, assetsCache, assetType)
+		if percent := thresholdPercent(updateCount, len(assetsCache)); percent > t.MaxUpdatedPercent {
+			breaches = append(breaches, fmt.Sprintf("%d of %d cached assets (%.1f%%) would be updated, the maximum is %.1f%%", updateCount, len(assetsCache), percent, t.MaxUpdatedPercent))
+		}
+	}
+	return
+}
+
+// enforceThresholds -- checks the thresholds of every asset type before any asset type is processed, logs any that are
+// breached, and ends the run unless -override-thresholds or -dryrun is set
+func enforceThresholds(assetTypes []preparedAssetTypeStruct) {
+	if configRehashOnly {
+		return
+	}
+	overridden := configIgnoreThresholds || configDryRun
+	logLevel := 4
+	if overridden {
+		logLevel = 5
+	}
+	breached := false
+	for _, prepared := range assetTypes {
+		assetType := prepared.AssetType
+		if prepared.Ready {
+			setAssetTypeGlobals(assetType)
+			assetMatchIndexes = buildMatchIndexes(prepared.AssetCache, assetType)
+		}
+		breaches := checkThresholds(prepared.ArrAssets, prepared.SourceAssets, prepared.AssetCache, assetType)
+		if len(breaches) == 0 {
+			continue
+		}
+		breached = true
+		logger(logLevel, "Mass-change thresholds breached for "+assetType.AssetType+" assets:", true, true)
+		for _, breach := range breaches {
+			logger(logLevel, "    "+breach, true, true)
+		}
+	}
+	if !breached {
+		return
+	}
+	if overridden {
+		logger(5, "Continuing as -override-thresholds or -dryrun is set", true, true)
+		return
+	}
+	logger(4, "The import has been aborted before any assets were changed. Check the source data, or run with -override-thresholds to import anyway", true, true)
+	os.Exit(103)
+}
+
+// countExpectedUpdates -- counts the source records that match a cached asset whose fingerprint differs, so would be updated
+func countExpectedUpdates(sourceAssets, assetsCache map[string]map[string]interface{}, assetType assetTypesStruct) (updateCount int) {
+	fingerprintColumn := getFingerprintColumn(assetType.Class)
+	scriptFunction := getScriptFunction(assetType)
+	for _, assetRecord := range sourceAssets {
+		if scriptFunction != "" {
+			var scriptBuffer bytes.Buffer
+			newAssetRecord, skip, err := runScript(scriptFunction, assetRecord, &scriptBuffer)
+			if err != nil || skip {
+				continue
+			}
+			assetRecord = newAssetRecord
+		}
+		cacheKey, _ := matchAsset(assetRecord)
+		asset, ok := assetsCache[cacheKey]
+		if !ok || cacheKey == "" {
+			continue
+		}
+		if forceRecords() || iToS(asset[fingerprintColumn]) != getRecordHash(assetType, assetRecord) {
+			updateCount++
+		}
+	}
+	return
+}
+
+func thresholdPercent(count, total int) float64 {
+	return float64(count) * 100 / float64(total)
+}
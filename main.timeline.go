@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- Asset timeline posts
+//-- When Timeline is enabled, the field changes and software inventory changes made to each asset are collected as
+//-- they are journaled, and once the asset has been processed a summary of them is posted to its timeline
+
+const (
+	defaultTimelineVisibility = "colleague"
+	defaultTimelineTemplate   = "Asset updated by the import:\n{{Changes}}\n{{Software}}"
+	defaultTimelineField      = "{{Field}}: {{OldValue}} -> {{NewValue}}"
+	defaultTimelineSoftware   = "Software: {{Added}} added, {{Removed}} removed"
+)
+
+type timelineChangesStruct struct {
+	Changes         []assetFieldChangeStruct
+	SoftwareAdded   int
+	SoftwareRemoved int
+	Created         bool
+}
+
+var timelineChanges = make(map[string]*timelineChangesStruct)
+
+// addTimelineChanges -- collects a journaled change against its asset, to be posted to the asset's timeline
+func addTimelineChanges(entry journalEntryStruct) {
+	if !SQLImportConf.Timeline.Enabled || configRollback != "" || entry.AssetID == "" {
+		return
+	}
+	mutexTimeline.Lock()
+	defer mutexTimeline.Unlock()
+	assetChanges, ok := timelineChanges[entry.AssetID]
+	if !ok {
+		assetChanges = &timelineChangesStruct{}
+	}
+	switch entry.Action {
+	case "Update", "Reclassify":
+		for _, change := range entry.Changes {
+			if change.Field != "h_dsc_fingerprint" && change.Field != "h_dsc_cf_fingerprint" && change.Field != "h_dsc_sw_fingerprint" && change.Field != "h_dsc_siid" {
+				assetChanges.Changes = append(assetChanges.Changes, change)
+			}
+		}
+	case "SoftwareAdd", "SoftwareRestore":
+		assetChanges.SoftwareAdded++
+	case "SoftwareDelete", "SoftwareRemove":
+		assetChanges.SoftwareRemoved++
+	case "Create":
+		assetChanges.Created = true
+	default:
+		return
+	}
+	timelineChanges[entry.AssetID] = assetChanges
+}
+
+// getTimelinePost -- builds the content of a timeline post from the configured templates
+func getTimelinePost(assetChanges *timelineChangesStruct) string {
+	conf := SQLImportConf.Timeline
+	template, fieldTemplate, softwareTemplate := conf.Template, conf.FieldTemplate, conf.SoftwareTemplate
+	if template == "" {
+		template = defaultTimelineTemplate
+	}
+	if fieldTemplate == "" {
+		fieldTemplate = defaultTimelineField
+	}
+	if softwareTemplate == "" {
+		softwareTemplate = defaultTimelineSoftware
+	}
+
+	var changeLines []string
+	for _, change := range assetChanges.Changes {
+		changeLines = append(changeLines, strings.NewReplacer(
+			"{{Field}}", change.Field,
+			"{{OldValue}}", change.OldValue,
+			"{{NewValue}}", change.NewValue,
+		).Replace(fieldTemplate))
+	}
+	software := ""
+	if assetChanges.SoftwareAdded > 0 || assetChanges.SoftwareRemoved > 0 {
+		software = strings.NewReplacer(
+			"{{Added}}", strconv.Itoa(assetChanges.SoftwareAdded),
+			"{{Removed}}", strconv.Itoa(assetChanges.SoftwareRemoved),
+		).Replace(softwareTemplate)
+	}
+	return strings.TrimSpace(strings.NewReplacer(
+		"{{Changes}}", strings.Join(changeLines, "\n"),
+		"{{Software}}", software,
+	).Replace(template))
+}
+
+// postAssetTimeline -- posts a summary of the changes made to an asset to its timeline
+// Nothing is posted for assets created by this run
+func postAssetTimeline(strAssetID string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	if !SQLImportConf.Timeline.Enabled || strAssetID == "" {
+		return
+	}
+	mutexTimeline.Lock()
+	assetChanges, ok := timelineChanges[strAssetID]
+	delete(timelineChanges, strAssetID)
+	mutexTimeline.Unlock()
+	if !ok || assetChanges.Created || (len(assetChanges.Changes) == 0 && assetChanges.SoftwareAdded == 0 && assetChanges.SoftwareRemoved == 0) {
+		return
+	}
+	if err := postTimeline(strAssetID, getTimelinePost(assetChanges), espXmlmc, buffer); err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to post changes to Asset timeline: "+err.Error()))
+		mutexCounters.Lock()
+		counters.timelineFailed++
+		mutexCounters.Unlock()
+		return
+	}
+	buffer.WriteString(loggerGen(1, "Changes posted to Asset timeline: "+strAssetID))
+	mutexCounters.Lock()
+	counters.timelinePosted++
+	mutexCounters.Unlock()
+}
+
+// postTimeline -- posts a message to the activity stream of an asset
+func postTimeline(strAssetID string, content string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) error {
+	visibility := SQLImportConf.Timeline.Visibility
+	if visibility == "" {
+		visibility = defaultTimelineVisibility
+	}
+	espXmlmc.SetParam("activityStreamID", "urn:sys:entity:"+appServiceManager+":Asset:"+strAssetID)
+	espXmlmc.SetParam("content", content)
+	espXmlmc.SetParam("visibility", visibility)
+	XMLSTRING := espXmlmc.GetParam()
+	if configDryRun {
+		buffer.WriteString(loggerGen(1, "Asset Timeline XML "+XMLSTRING))
+		espXmlmc.ClearParam()
+		return nil
+	}
+	debugLog(buffer, "Asset Timeline XML:", XMLSTRING)
+	XMLPost, xmlmcErr := espXmlmc.Invoke("activity", "postMessage")
+	if xmlmcErr != nil {
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		return errors.New("API Call failed: " + xmlmcErr.Error())
+	}
+	var xmlRespon xmlmcResponse
+	err := xml.Unmarshal([]byte(XMLPost), &xmlRespon)
+	if err != nil {
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		return errors.New("Unable to read response from Hornbill instance: " + err.Error())
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(1, "API Call XML: "+XMLSTRING))
+		return errors.New(xmlRespon.State.ErrorRet)
+	}
+	return nil
+}
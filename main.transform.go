@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//-- Mapping expressions
+//-- Any part of a mapping value wrapped in {{ }} is evaluated as an expression, for example:
+//-- {{upper(trim([MachineName]))}} or {{coalesce([UserName],[LastUser])}}
+//-- Arguments can be [Column] references, 'quoted strings', numbers or other function calls
+
+type exprNode struct {
+	function string
+	column   string
+	literal  string
+	isColumn bool
+	args     []exprNode
+}
+
+type exprFunc func(args []string) (string, error)
+
+var (
+	exprFunctions     map[string]exprFunc
+	exprRegexCache    = make(map[string]*regexp.Regexp)
+	errExprUnexpected = errors.New("unexpected end of expression")
+)
+
+func init() {
+	exprFunctions = map[string]exprFunc{
+		"upper":        exprFixedArgs(1, func(a []string) (string, error) { return strings.ToUpper(a[0]), nil }),
+		"lower":        exprFixedArgs(1, func(a []string) (string, error) { return strings.ToLower(a[0]), nil }),
+		"trim":         exprFixedArgs(1, func(a []string) (string, error) { return strings.TrimSpace(a[0]), nil }),
+		"ltrim":        exprFixedArgs(1, func(a []string) (string, error) { return strings.TrimLeftFunc(a[0], unicode.IsSpace), nil }),
+		"rtrim":        exprFixedArgs(1, func(a []string) (string, error) { return strings.TrimRightFunc(a[0], unicode.IsSpace), nil }),
+		"left":         exprFixedArgs(2, exprLeft),
+		"right":        exprFixedArgs(2, exprRight),
+		"substr":       exprFixedArgs(3, exprSubstr),
+		"replace":      exprFixedArgs(3, func(a []string) (string, error) { return strings.ReplaceAll(a[0], a[1], a[2]), nil }),
+		"regexreplace": exprFixedArgs(3, exprRegexReplace),
+		"concat":       func(a []string) (string, error) { return strings.Join(a, ""), nil },
+		"coalesce":     exprCoalesce,
+		"default":      exprFixedArgs(2, exprCoalesce),
+		"lookup":       exprLookup,
+		"equals":       exprFixedArgs(2, func(a []string) (string, error) { return exprBool(strings.EqualFold(a[0], a[1])), nil }),
+		"contains":     exprFixedArgs(2, exprContains),
+		"startswith":   exprFixedArgs(2, exprStartsWith),
+		"endswith":     exprFixedArgs(2, exprEndsWith),
+		"matches":      exprFixedArgs(2, exprMatches),
+		"isempty":      exprFixedArgs(1, func(a []string) (string, error) { return exprBool(strings.TrimSpace(a[0]) == ""), nil }),
+		"not":          exprFixedArgs(1, func(a []string) (string, error) { return exprBool(!exprTrue(a[0])), nil }),
+		"and":          exprAnd,
+		"or":           exprOr,
+		"if":           exprFixedArgs(3, exprIf),
+	}
+}
+
+// evalExpression -- parses and evaluates a single mapping expression against a source record
+func evalExpression(expr string, u map[string]interface{}) (string, error) {
+	p := exprParser{src: expr}
+	node, err := p.parseExpr()
+	if err != nil {
+		return "", err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return "", errors.New("unexpected character '" + string(p.src[p.pos]) + "' at position " + strconv.Itoa(p.pos+1))
+	}
+	return node.eval(u)
+}
+
+func (n exprNode) eval(u map[string]interface{}) (string, error) {
+	if n.isColumn {
+		if n.column == "HBAssetType" {
+			return StrAssetType, nil
+		}
+		return iToS(u[n.column]), nil
+	}
+	if n.function == "" {
+		return n.literal, nil
+	}
+	fn, ok := exprFunctions[strings.ToLower(n.function)]
+	if !ok {
+		return "", errors.New("unknown function " + n.function)
+	}
+	var args []string
+	for _, a := range n.args {
+		val, err := a.eval(u)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, val)
+	}
+	val, err := fn(args)
+	if err != nil {
+		return "", errors.New(n.function + ": " + err.Error())
+	}
+	return val, nil
+}
+
+//-- Parser
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) parseExpr() (node exprNode, err error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		err = errExprUnexpected
+		return
+	}
+	switch c := p.src[p.pos]; {
+	case c == '[':
+		end := strings.IndexByte(p.src[p.pos:], ']')
+		if end == -1 {
+			err = errors.New("missing ] after column name")
+			return
+		}
+		node.isColumn = true
+		node.column = p.src[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+	case c == '\'':
+		node.literal, err = p.parseString()
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		node.literal = p.src[start:p.pos]
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		node.function = p.src[start:p.pos]
+		node.args, err = p.parseArgs()
+	default:
+		err = errors.New("unexpected character '" + string(c) + "' at position " + strconv.Itoa(p.pos+1))
+	}
+	return
+}
+
+// parseString -- reads a single-quoted string, a quote is escaped by doubling it
+func (p *exprParser) parseString() (string, error) {
+	var sb strings.Builder
+	p.pos++
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		if c == '\'' {
+			if p.pos < len(p.src) && p.src[p.pos] == '\'' {
+				sb.WriteByte('\'')
+				p.pos++
+				continue
+			}
+			return sb.String(), nil
+		}
+		sb.WriteByte(c)
+	}
+	return "", errors.New("missing closing quote")
+}
+
+func (p *exprParser) parseArgs() (args []exprNode, err error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != '(' {
+		err = errors.New("expected ( after function name")
+		return
+	}
+	p.pos++
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == ')' {
+		p.pos++
+		return
+	}
+	for {
+		var arg exprNode
+		arg, err = p.parseExpr()
+		if err != nil {
+			return
+		}
+		args = append(args, arg)
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			err = errExprUnexpected
+			return
+		}
+		switch p.src[p.pos] {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return
+		default:
+			err = errors.New("expected , or ) at position " + strconv.Itoa(p.pos+1))
+			return
+		}
+	}
+}
+
+//-- Functions
+
+func exprFixedArgs(count int, fn exprFunc) exprFunc {
+	return func(args []string) (string, error) {
+		if len(args) != count {
+			return "", errors.New("expected " + strconv.Itoa(count) + " arguments, got " + strconv.Itoa(len(args)))
+		}
+		return fn(args)
+	}
+}
+
+func exprCoalesce(args []string) (string, error) {
+	for _, a := range args {
+		if a != "" {
+			return a, nil
+		}
+	}
+	return "", nil
+}
+
+func exprLeft(args []string) (string, error) {
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		return "", errors.New("invalid length " + args[1])
+	}
+	r := []rune(args[0])
+	if n > len(r) {
+		n = len(r)
+	}
+	return string(r[:n]), nil
+}
+
+func exprRight(args []string) (string, error) {
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		return "", errors.New("invalid length " + args[1])
+	}
+	r := []rune(args[0])
+	if n > len(r) {
+		n = len(r)
+	}
+	return string(r[len(r)-n:]), nil
+}
+
+// exprSubstr -- substr(value, start, length), start is 1-based to match SQL SUBSTRING
+func exprSubstr(args []string) (string, error) {
+	start, err := strconv.Atoi(args[1])
+	if err != nil || start < 1 {
+		return "", errors.New("invalid start " + args[1])
+	}
+	length, err := strconv.Atoi(args[2])
+	if err != nil || length < 0 {
+		return "", errors.New("invalid length " + args[2])
+	}
+	r := []rune(args[0])
+	if start > len(r) {
+		return "", nil
+	}
+	end := start - 1 + length
+	if end > len(r) {
+		end = len(r)
+	}
+	return string(r[start-1 : end]), nil
+}
+
+func exprRegexReplace(args []string) (string, error) {
+	re, err := exprRegex(args[1])
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(args[0], args[2]), nil
+}
+
+func exprMatches(args []string) (string, error) {
+	re, err := exprRegex(args[1])
+	if err != nil {
+		return "", err
+	}
+	return exprBool(re.MatchString(args[0])), nil
+}
+
+// exprRegex -- returns a compiled regular expression, cached as the same patterns are used for every record
+func exprRegex(pattern string) (*regexp.Regexp, error) {
+	mutexExprRegex.Lock()
+	defer mutexExprRegex.Unlock()
+	if re, ok := exprRegexCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	exprRegexCache[pattern] = re
+	return re, nil
+}
+
+// exprContains, exprStartsWith & exprEndsWith -- text comparisons are not case sensitive
+func exprContains(args []string) (string, error) {
+	return exprBool(strings.Contains(strings.ToLower(args[0]), strings.ToLower(args[1]))), nil
+}
+
+func exprStartsWith(args []string) (string, error) {
+	return exprBool(strings.HasPrefix(strings.ToLower(args[0]), strings.ToLower(args[1]))), nil
+}
+
+func exprEndsWith(args []string) (string, error) {
+	return exprBool(strings.HasSuffix(strings.ToLower(args[0]), strings.ToLower(args[1]))), nil
+}
+
+func exprAnd(args []string) (string, error) {
+	for _, a := range args {
+		if !exprTrue(a) {
+			return exprBool(false), nil
+		}
+	}
+	return exprBool(len(args) > 0), nil
+}
+
+func exprOr(args []string) (string, error) {
+	for _, a := range args {
+		if exprTrue(a) {
+			return exprBool(true), nil
+		}
+	}
+	return exprBool(false), nil
+}
+
+func exprIf(args []string) (string, error) {
+	if exprTrue(args[0]) {
+		return args[1], nil
+	}
+	return args[2], nil
+}
+
+func exprBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+// exprTrue -- an expression result is true unless it is empty, false or 0
+func exprTrue(s string) bool {
+	s = strings.TrimSpace(s)
+	return s != "" && s != "0" && !strings.EqualFold(s, "false")
+}
+
+// exprLookup -- lookup('table', value[, default]) translates a value using a table from the Lookups configuration
+func exprLookup(args []string) (string, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return "", errors.New("expected 2 or 3 arguments, got " + strconv.Itoa(len(args)))
+	}
+	table, ok := SQLImportConf.Lookups[args[0]]
+	if !ok {
+		return "", errors.New("lookup table " + args[0] + " not found in configuration")
+	}
+	if val, ok := table.Values[args[1]]; ok {
+		return val, nil
+	}
+	for k, val := range table.Values {
+		if strings.EqualFold(k, strings.TrimSpace(args[1])) {
+			return val, nil
+		}
+	}
+	if len(args) == 3 {
+		return args[2], nil
+	}
+	if table.Default != nil {
+		return *table.Default, nil
+	}
+	return args[1], nil
+}
+
+// getFieldMapping -- Returns the mapping template to use for a field against the current record
+// A mapping can be a plain template string, or an object containing a Value template or ordered rules that are evaluated per record:
+// {"Rules":[{"When":"contains([SystemModel],'Virtual')","Value":"Virtual [MachineName]"}],"Default":"[MachineName]"}
+func getFieldMapping(k string, v interface{}, u map[string]interface{}, buffer *bytes.Buffer) string {
+	ruleMapping, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Sprintf("%v", v)
+	}
+	if value, ok := ruleMapping["Value"]; ok {
+		return iToS(value)
+	}
+	rules, _ := ruleMapping["Rules"].([]interface{})
+	for i, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			buffer.WriteString(loggerGen(4, "Mapping rule "+strconv.Itoa(i+1)+" for "+k+" is not an object"))
+			continue
+		}
+		when := strings.TrimSpace(iToS(rule["When"]))
+		when = strings.TrimSuffix(strings.TrimPrefix(when, "{{"), "}}")
+		result, err := evalExpression(when, u)
+		if err != nil {
+			buffer.WriteString(loggerGen(4, "Unable to evaluate mapping rule "+strconv.Itoa(i+1)+" for "+k+" ["+when+"]: "+err.Error()))
+			continue
+		}
+		if exprTrue(result) {
+			debugLog(buffer, "Mapping rule matched:", k, ":", strconv.Itoa(i+1), ":", when)
+			return iToS(rule["Value"])
+		}
+	}
+	debugLog(buffer, "No mapping rule matched, using default:", k)
+	return iToS(ruleMapping["Default"])
+}
+
+// checkFieldModes -- Checks that the Mode of each field mapping object is one that is supported
+func checkFieldModes() error {
+	mappings := map[string]map[string]interface{}{
+		"AssetGenericFieldMapping": SQLImportConf.AssetGenericFieldMapping,
+		"AssetTypeFieldMapping":    SQLImportConf.AssetTypeFieldMapping,
+	}
+	for name, fieldMapping := range mappings {
+		for k, v := range fieldMapping {
+			mapping, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			mode, ok := mapping["Mode"]
+			if !ok {
+				continue
+			}
+			switch strings.ToLower(iToS(mode)) {
+			case "always", "createonly", "updateonly", "fillifempty", "never":
+			default:
+				return errors.New(name + " Mode for " + k + " must be Always, CreateOnly, UpdateOnly, FillIfEmpty or Never, not \"" + iToS(mode) + "\"")
+			}
+		}
+	}
+	return nil
+}
+
+// fieldModeAllowed -- Returns true if a mapped field should be written for the operation (create or update)
+// The Mode of a mapping object can be Always (the default), CreateOnly, UpdateOnly, FillIfEmpty or Never
+func fieldModeAllowed(v interface{}, operation string) bool {
+	mapping, ok := v.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	switch strings.ToLower(iToS(mapping["Mode"])) {
+	case "createonly":
+		return operation == "create"
+	case "updateonly":
+		return operation == "update"
+	case "never":
+		return false
+	}
+	return true
+}
+
+// fieldFilled -- Returns true if a FillIfEmpty field already has a value in the cached Hornbill record, so should not be updated
+// A field that is not returned in the cached record is treated as filled, as its current value is not known
+func fieldFilled(v interface{}, k string, hbRecord map[string]interface{}, buffer *bytes.Buffer) bool {
+	mapping, ok := v.(map[string]interface{})
+	if !ok || !strings.EqualFold(iToS(mapping["Mode"]), "fillifempty") || hbRecord == nil {
+		return false
+	}
+	value, ok := hbRecord[k]
+	if !ok {
+		buffer.WriteString(loggerGen(5, "FillIfEmpty field "+k+" is not returned in the Hornbill asset cache, so it will not be updated"))
+		return true
+	}
+	return strings.TrimSpace(iToS(value)) != ""
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- Asset type change detection
+//-- When DetectTypeChanges is set, the Hornbill assets of every configured type are cached before any type is processed.
+//-- Source records that do not match an asset of their own type are then checked against the caches of the other types,
+//-- and a matching asset is reclassified to the new type instead of a duplicate asset being created
+
+type typeCacheStruct struct {
+	AssetType assetTypesStruct
+	Cache     map[string]map[string]interface{}
+	Indexes   []assetMatchIndexStruct
+}
+
+type pendingMissingAssetsStruct struct {
+	AssetType assetTypesStruct
+	ArrAssets map[string]map[string]interface{}
+	Cache     map[string]map[string]interface{}
+}
+
+var (
+	typeCaches           []typeCacheStruct
+	movedAssets          = make(map[string]bool)
+	previewMovedAssets   = make(map[string]bool) //Assets that would have been reclassified, in dry run and plan mode
+	pendingMissingAssets []pendingMissingAssetsStruct
+)
+
+// loadTypeCaches -- caches the Hornbill assets of every configured asset type, so records can be matched across types
+func loadTypeCaches() {
+	if !SQLImportConf.DetectTypeChanges {
+		return
+	}
+	for _, v := range SQLImportConf.AssetTypes {
+		v = setAssetType(v)
+		if v.Class == "" || v.TypeID == 0 {
+			continue
+		}
+		assetCache, err := cacheAssetType(v)
+		if err != nil {
+			logger(4, err.Error(), true, true)
+			continue
+		}
+		typeCaches = append(typeCaches, typeCacheStruct{AssetType: v, Cache: assetCache, Indexes: buildMatchIndexes(assetCache, v)})
+	}
+}
+
+// getTypeCache -- returns the preloaded Hornbill asset cache of an asset type
+func getTypeCache(assetType assetTypesStruct) (map[string]map[string]interface{}, bool) {
+	for _, typeCache := range typeCaches {
+		if typeCache.AssetType.AssetType == assetType.AssetType {
+			return typeCache.Cache, true
+		}
+	}
+	return nil, false
+}
+
+// findMovedAsset -- checks a source record that did not match an asset of its own type against the caches of the other
+// asset types, and returns the type and cached record of the first asset that matches
+func findMovedAsset(u map[string]interface{}, assetType assetTypesStruct) (fromType assetTypesStruct, hbRecord map[string]interface{}, ruleName string) {
+	if configRehashOnly {
+		return
+	}
+	for _, typeCache := range typeCaches {
+		if typeCache.AssetType.AssetType == assetType.AssetType {
+			continue
+		}
+		cacheKey, matchRule := matchAssetIndexes(u, typeCache.Indexes)
+		if cacheKey == "" {
+			continue
+		}
+		asset := typeCache.Cache[cacheKey]
+		mutexMovedAssets.Lock()
+		moved := movedAssets[iToS(asset["h_pk_asset_id"])] || previewMovedAssets[iToS(asset["h_pk_asset_id"])]
+		mutexMovedAssets.Unlock()
+		if !moved {
+			return typeCache.AssetType, asset, matchRule
+		}
+	}
+	return
+}
+
+// isMovedAsset -- returns true if the asset has been reclassified to another type during this run
+func isMovedAsset(hbRecord map[string]interface{}) bool {
+	mutexMovedAssets.Lock()
+	defer mutexMovedAssets.Unlock()
+	return movedAssets[iToS(hbRecord["h_pk_asset_id"])] || previewMovedAssets[iToS(hbRecord["h_pk_asset_id"])]
+}
+
+// deferMissingAssets -- returns true if the missing assets of a type should be processed once every type has been processed,
+// so that assets which have moved to a type processed later are not retired
+func deferMissingAssets(arrAssets, assetsCache map[string]map[string]interface{}, assetType assetTypesStruct) bool {
+	if !SQLImportConf.DetectTypeChanges {
+		return false
+	}
+	pendingMissingAssets = append(pendingMissingAssets, pendingMissingAssetsStruct{AssetType: assetType, ArrAssets: arrAssets, Cache: assetsCache})
+	return true
+}
+
+// processPendingMissingAssets -- processes the missing assets of each type that were deferred by deferMissingAssets
+func processPendingMissingAssets() {
+	for _, pending := range pendingMissingAssets {
+		assetMatchIndexes = buildMatchIndexes(pending.Cache, pending.AssetType)
+		processMissingAssets(pending.ArrAssets, pending.Cache, pending.AssetType)
+	}
+}
+
+// reclassifyAsset -- moves an existing Hornbill asset to the asset type being processed
+// The asset type and class are updated, and if the class has changed an extended record of the new class is inserted.
+// The extended record of the old class is journaled, and only removed once the asset has been moved
+func reclassifyAsset(hbRecord map[string]interface{}, fromType, toType assetTypesStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+	strAssetID := iToS(hbRecord["h_pk_asset_id"])
+	buffer.WriteString(loggerGen(1, "Reclassify Asset "+strAssetID+" from "+fromType.AssetType+" ("+fromType.Class+") to "+toType.AssetType+" ("+toType.Class+")"))
+
+	classChanged := fromType.Class != toType.Class
+	fromEntity := ""
+	if classChanged {
+		fromEntity = getClassEntity(fromType.Class)
+	}
+
+	//Read the extended record of the old class, so that its values can be restored by a rollback
+	var extendedRecord map[string]string
+	if fromEntity != "" && journalEnabled() {
+		var err error
+		extendedRecord, err = getEntityRecord(fromEntity, strAssetID, espXmlmc, buffer)
+		if err != nil {
+			buffer.WriteString(loggerGen(4, "Unable to read "+fromType.Class+" extended record: "+err.Error()))
+			mutexCounters.Lock()
+			counters.moveFailed++
+			mutexCounters.Unlock()
+			return false
+		}
+	}
+
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Asset")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_asset_id", strAssetID)
+	espXmlmc.SetParam("h_type", strconv.Itoa(toType.TypeID))
+	espXmlmc.SetParam("h_class", toType.Class)
+	espXmlmc.SetParam("h_last_updated", time.Now().Format("2006-01-02 15:04:05"))
+	espXmlmc.SetParam("h_last_updated_by", "Import - Reclassify")
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	if classChanged {
+		espXmlmc.OpenElement("relatedEntityData")
+		espXmlmc.SetParam("relationshipName", "AssetClass")
+		espXmlmc.SetParam("entityAction", "insert")
+		espXmlmc.OpenElement("record")
+		espXmlmc.SetParam("h_type", strconv.Itoa(toType.TypeID))
+		espXmlmc.CloseElement("record")
+		espXmlmc.CloseElement("relatedEntityData")
+	}
+	if err := invokeEntityChange(espXmlmc, "entityUpdateRecord", "Asset Reclassify", buffer); err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to reclassify Asset: "+err.Error()))
+		mutexCounters.Lock()
+		counters.moveFailed++
+		mutexCounters.Unlock()
+		return false
+	}
+
+	writeJournal(journalEntryStruct{Action: "Reclassify", AssetID: strAssetID, Entity: fromEntity, Record: extendedRecord, Changes: []assetFieldChangeStruct{
+		{Entity: "Asset", Field: "h_type", OldValue: strconv.Itoa(fromType.TypeID), NewValue: strconv.Itoa(toType.TypeID)},
+		{Entity: "Asset", Field: "h_class", OldValue: fromType.Class, NewValue: toType.Class},
+	}}, buffer)
+
+	if fromEntity != "" {
+		espXmlmc.SetParam("application", appServiceManager)
+		espXmlmc.SetParam("entity", fromEntity)
+		espXmlmc.SetParam("keyValue", strAssetID)
+		if err := invokeEntityChange(espXmlmc, "entityDeleteRecord", "Asset Reclassify", buffer); err != nil {
+			buffer.WriteString(loggerGen(4, "Asset reclassified, but unable to remove "+fromType.Class+" extended record: "+err.Error()))
+		}
+	}
+
+	markMovedAsset(strAssetID)
+	if configDryRun {
+		return true
+	}
+	mutexCounters.Lock()
+	counters.moved++
+	mutexCounters.Unlock()
+	buffer.WriteString(loggerGen(1, "Asset reclassified successfully: "+strAssetID))
+	return true
+}
+
+// getMovedAssetRecord -- returns the cached record of an asset that has been reclassified, to compare the source record against
+// If the class has changed, the extended record of the new class was inserted empty, so the extended fields are blanked
+// rather than compared against the values of the old class
+func getMovedAssetRecord(hbRecord map[string]interface{}, fromType, toType assetTypesStruct) map[string]interface{} {
+	if fromType.Class == toType.Class {
+		return hbRecord
+	}
+	movedRecord := make(map[string]interface{}, len(hbRecord))
+	for k, v := range hbRecord {
+		movedRecord[k] = v
+	}
+	for k := range SQLImportConf.AssetTypeFieldMapping {
+		movedRecord[k] = ""
+	}
+	movedRecord[getFingerprintColumn(toType.Class)] = ""
+	return movedRecord
+}
+
+// markMovedAsset -- records that an asset has been reclassified, so it is not matched or treated as missing by its old type
+// In dry run mode the asset has not been moved, so it is only recorded as a previewed move
+func markMovedAsset(strAssetID string) {
+	mutexMovedAssets.Lock()
+	defer mutexMovedAssets.Unlock()
+	if configDryRun {
+		previewMovedAssets[strAssetID] = true
+		return
+	}
+	movedAssets[strAssetID] = true
+}